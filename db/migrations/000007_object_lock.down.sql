@@ -0,0 +1,12 @@
+ALTER TABLE multipart_uploads DROP COLUMN legal_hold;
+ALTER TABLE multipart_uploads DROP COLUMN retain_until;
+ALTER TABLE multipart_uploads DROP COLUMN retention_mode;
+
+ALTER TABLE objects DROP COLUMN legal_hold;
+ALTER TABLE objects DROP COLUMN retain_until;
+ALTER TABLE objects DROP COLUMN retention_mode;
+
+ALTER TABLE buckets DROP COLUMN default_retention_years;
+ALTER TABLE buckets DROP COLUMN default_retention_days;
+ALTER TABLE buckets DROP COLUMN default_retention_mode;
+ALTER TABLE buckets DROP COLUMN object_lock_enabled;
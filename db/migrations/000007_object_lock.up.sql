@@ -0,0 +1,13 @@
+ALTER TABLE buckets ADD COLUMN object_lock_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE buckets ADD COLUMN default_retention_mode TEXT; -- 'GOVERNANCE' | 'COMPLIANCE'
+ALTER TABLE buckets ADD COLUMN default_retention_days INTEGER;
+ALTER TABLE buckets ADD COLUMN default_retention_years INTEGER;
+
+ALTER TABLE objects ADD COLUMN retention_mode TEXT; -- 'GOVERNANCE' | 'COMPLIANCE'
+ALTER TABLE objects ADD COLUMN retain_until TIMESTAMP;
+ALTER TABLE objects ADD COLUMN legal_hold BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- The object lock of a multipart upload is given when it is initiated and applied when it completes
+ALTER TABLE multipart_uploads ADD COLUMN retention_mode TEXT; -- 'GOVERNANCE' | 'COMPLIANCE'
+ALTER TABLE multipart_uploads ADD COLUMN retain_until TIMESTAMP;
+ALTER TABLE multipart_uploads ADD COLUMN legal_hold BOOLEAN NOT NULL DEFAULT FALSE;
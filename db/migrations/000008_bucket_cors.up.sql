@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS bucket_cors (
+    bucket_id INTEGER PRIMARY KEY,
+    configuration TEXT NOT NULL, -- CORSConfiguration XML document
+    FOREIGN KEY (bucket_id) REFERENCES buckets(id) ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_file_content_file_id;
+DROP INDEX IF EXISTS idx_files_user_id_path;
+
+DROP TABLE IF EXISTS directories;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS directories (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	path TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(user_id, path)
+);
+
+CREATE INDEX IF NOT EXISTS idx_files_user_id_path ON files(user_id, path);
+CREATE INDEX IF NOT EXISTS idx_file_content_file_id ON file_content(file_id, chunk_index);
+
+-- Create the parent directories of existing files, e.g. "/a" and "/a/b" for "/a/b/c.txt"
+WITH RECURSIVE parents(user_id, path) AS (
+	SELECT user_id, rtrim(rtrim(path, replace(path, '/', '')), '/') FROM files
+	UNION
+	SELECT user_id, rtrim(rtrim(path, replace(path, '/', '')), '/') FROM parents WHERE path != ''
+)
+INSERT OR IGNORE INTO directories (user_id, path)
+SELECT user_id, path FROM parents WHERE path != '';
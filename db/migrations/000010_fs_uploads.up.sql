@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS file_uploads (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	file_id INTEGER NOT NULL, -- Staging file receiving the chunks until the upload is finalised
+	path TEXT NOT NULL, -- Target path of the file
+	length INTEGER NOT NULL,
+	offset INTEGER NOT NULL DEFAULT 0,
+	overwrite BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP NOT NULL, -- Pushed back whenever data is received, then the staging file is deleted
+	FOREIGN KEY (file_id) REFERENCES files (id)
+);
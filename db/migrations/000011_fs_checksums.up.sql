@@ -0,0 +1,2 @@
+-- SHA-256 of the file content, used as ETag. Computed on first read for existing files.
+ALTER TABLE files ADD COLUMN sha256 TEXT;
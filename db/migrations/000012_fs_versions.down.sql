@@ -0,0 +1,5 @@
+DELETE FROM file_content WHERE file_id IN (SELECT content_id FROM file_versions);
+DELETE FROM files WHERE id IN (SELECT content_id FROM file_versions);
+DROP TABLE IF EXISTS file_versions;
+
+ALTER TABLE files DROP COLUMN version;
@@ -0,0 +1,12 @@
+ALTER TABLE files ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+-- Previous versions of files. The content of each version is kept in an internal files row
+-- (path ".versions/<file_id>/<version>"), so it can be read like any other file.
+CREATE TABLE IF NOT EXISTS file_versions (
+	file_id INTEGER NOT NULL,
+	version INTEGER NOT NULL,
+	content_id INTEGER NOT NULL,
+	PRIMARY KEY (file_id, version),
+	FOREIGN KEY (file_id) REFERENCES files (id),
+	FOREIGN KEY (content_id) REFERENCES files (id)
+);
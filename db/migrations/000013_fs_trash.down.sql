@@ -0,0 +1,13 @@
+-- Purge everything in the trash, including the versions of trashed files
+DELETE FROM file_content WHERE file_id IN (
+	SELECT content_id FROM file_versions WHERE file_id IN (SELECT id FROM files WHERE path LIKE '.trash/%')
+);
+DELETE FROM files WHERE id IN (
+	SELECT content_id FROM file_versions WHERE file_id IN (SELECT id FROM files WHERE path LIKE '.trash/%')
+);
+DELETE FROM file_versions WHERE file_id IN (SELECT id FROM files WHERE path LIKE '.trash/%');
+DELETE FROM file_content WHERE file_id IN (SELECT id FROM files WHERE path LIKE '.trash/%');
+DELETE FROM files WHERE path LIKE '.trash/%';
+DELETE FROM directories WHERE path LIKE '.trash/%';
+
+DROP TABLE IF EXISTS trash;
@@ -0,0 +1,12 @@
+-- Deleted files and directories. Their rows are moved under the internal path ".trash/<id>",
+-- e.g. ".trash/12/user/files/README.md", until they are restored or purged.
+CREATE TABLE IF NOT EXISTS trash (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	path TEXT NOT NULL, -- Original path
+	type TEXT NOT NULL, -- "file" | "directory"
+	size INTEGER NOT NULL DEFAULT 0,
+	deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_trash_user_id ON trash(user_id);
@@ -0,0 +1,6 @@
+-- Full-text index of the text content of files, the rowid is the ID of the file.
+-- Requires SQLite with FTS5, i.e. building with `-tags sqlite_fts5`.
+CREATE VIRTUAL TABLE IF NOT EXISTS file_search USING fts5(
+	content,
+	tokenize = 'porter unicode61 remove_diacritics 2'
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS file_shares (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token TEXT NOT NULL UNIQUE,
+	user_id TEXT NOT NULL,
+	path TEXT NOT NULL, -- Shared file or directory
+	mode TEXT NOT NULL DEFAULT 'read', -- "read" | "upload"
+	password_hash TEXT, -- PBKDF2, NULL if the link has no password
+	expires_at TIMESTAMP,
+	max_downloads INTEGER,
+	downloads INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_shares_user_id ON file_shares(user_id);
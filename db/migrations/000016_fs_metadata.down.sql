@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS file_attributes;
+
+ALTER TABLE files DROP COLUMN modified_at;
+ALTER TABLE files DROP COLUMN mime_type;
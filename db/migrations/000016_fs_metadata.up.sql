@@ -0,0 +1,15 @@
+-- MIME type of the content, detected on upload unless set by the client.
+ALTER TABLE files ADD COLUMN mime_type TEXT;
+
+-- Time the content was last modified. created_at is the time the file was created at its path.
+ALTER TABLE files ADD COLUMN modified_at TIMESTAMP;
+UPDATE files SET modified_at = created_at;
+
+-- Key/value attributes set by the owner of a file
+CREATE TABLE IF NOT EXISTS file_attributes (
+	file_id INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (file_id, key),
+	FOREIGN KEY (file_id) REFERENCES files (id)
+);
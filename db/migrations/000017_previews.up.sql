@@ -0,0 +1,12 @@
+-- Thumbnails of images and excerpts of text documents, generated on demand. A preview is outdated
+-- when the checksum of its source changes, and is then generated again.
+CREATE TABLE IF NOT EXISTS previews (
+	source TEXT NOT NULL, -- "file" | "object"
+	source_id INTEGER NOT NULL, -- ID in the files or objects table
+	variant TEXT NOT NULL, -- Requested size, e.g. "256x256,500"
+	source_etag TEXT NOT NULL, -- Checksum of the source the preview was generated from
+	content_type TEXT NOT NULL,
+	data BLOB NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (source, source_id, variant)
+);
@@ -0,0 +1,13 @@
+-- Changes to the files and directories of users. The ID is the cursor of the change feed.
+-- Changes to a directory apply to everything inside it.
+CREATE TABLE IF NOT EXISTS fs_changes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	action TEXT NOT NULL, -- "create" | "update" | "delete" | "move"
+	type TEXT NOT NULL, -- "file" | "directory"
+	path TEXT NOT NULL,
+	old_path TEXT, -- Previous path of moved files and directories
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_fs_changes_user_id ON fs_changes(user_id, id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_chats_user_id_timestamp;
@@ -0,0 +1,2 @@
+-- Chats are listed by last activity
+CREATE INDEX IF NOT EXISTS idx_chats_user_id_timestamp ON chats(user_id, timestamp DESC, id DESC);
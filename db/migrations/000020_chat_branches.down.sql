@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_messages_parent_id;
+
+ALTER TABLE chats DROP COLUMN active_leaf_id;
+ALTER TABLE messages DROP COLUMN edited_at;
+ALTER TABLE messages DROP COLUMN parent_id;
@@ -0,0 +1,23 @@
+-- Messages form a tree: a message replies to its parent, and messages sharing a parent are branches
+-- of the conversation. The active leaf is the last message of the branch shown in the chat.
+ALTER TABLE messages ADD COLUMN parent_id TEXT;
+ALTER TABLE messages ADD COLUMN edited_at INTEGER;
+ALTER TABLE chats ADD COLUMN active_leaf_id TEXT;
+
+-- Existing conversations are linear: each message replies to the previous one
+UPDATE messages SET parent_id = (
+	SELECT p.id FROM messages p
+	WHERE p.chat_id = messages.chat_id
+		AND (p.timestamp < messages.timestamp OR (p.timestamp = messages.timestamp AND p.rowid < messages.rowid))
+	ORDER BY p.timestamp DESC, p.rowid DESC
+	LIMIT 1
+);
+
+UPDATE chats SET active_leaf_id = (
+	SELECT m.id FROM messages m
+	WHERE m.chat_id = chats.id
+	ORDER BY m.timestamp DESC, m.rowid DESC
+	LIMIT 1
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_parent_id ON messages(parent_id);
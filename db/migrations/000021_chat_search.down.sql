@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS chat_search;
+DROP TABLE IF EXISTS message_search;
+DROP TABLE IF EXISTS chat_search_ids;
+DROP TABLE IF EXISTS message_search_ids;
@@ -0,0 +1,32 @@
+-- Full-text indexes of the content of messages and the titles of chats. Requires SQLite with FTS5, i.e.
+-- building with `-tags sqlite_fts5`.
+--
+-- The rowid of an index entry is the id of the message or chat in message_search_ids or chat_search_ids,
+-- not the rowid of messages or chats, which a VACUUM can renumber as both have TEXT primary keys.
+CREATE TABLE IF NOT EXISTS message_search_ids (
+	id INTEGER PRIMARY KEY,
+	message_id TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS chat_search_ids (
+	id INTEGER PRIMARY KEY,
+	chat_id TEXT NOT NULL UNIQUE
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS message_search USING fts5(
+	content,
+	tokenize = 'porter unicode61 remove_diacritics 2'
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS chat_search USING fts5(
+	title,
+	tokenize = 'porter unicode61 remove_diacritics 2'
+);
+
+INSERT INTO message_search_ids (message_id) SELECT id FROM messages;
+INSERT INTO chat_search_ids (chat_id) SELECT id FROM chats;
+
+INSERT INTO message_search (rowid, content)
+SELECT i.id, m.content FROM message_search_ids i JOIN messages m ON m.id = i.message_id;
+INSERT INTO chat_search (rowid, title)
+SELECT i.id, c.title FROM chat_search_ids i JOIN chats c ON c.id = i.chat_id;
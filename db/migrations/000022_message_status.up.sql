@@ -0,0 +1,3 @@
+-- Assistant replies can be streamed: a message is created as 'streaming', its content grows as
+-- deltas are appended, and it becomes 'complete' when finished.
+ALTER TABLE messages ADD COLUMN status TEXT NOT NULL DEFAULT 'complete';
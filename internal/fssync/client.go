@@ -0,0 +1,266 @@
+package fssync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// remoteFile is a file or directory as returned by the Files API.
+type remoteFile struct {
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// changesPage is a page of the change feed of the Files API.
+type changesPage struct {
+	Changes []json.RawMessage `json:"changes"`
+	Cursor  int64             `json:"cursor"`
+	HasMore bool              `json:"has_more"`
+}
+
+// client calls the Files API of a portal server on behalf of a user.
+type client struct {
+	baseURL string
+	userID  string
+	http    *http.Client
+}
+
+// responseError is an error response of the Files API.
+type responseError struct {
+	method string
+	path   string
+	status int
+	body   string
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.method, e.path, e.status, strings.TrimSpace(e.body))
+}
+
+func isNotFound(err error) bool {
+	re, ok := err.(*responseError)
+	return ok && re.status == http.StatusNotFound
+}
+
+// fileURL returns the URL of an endpoint followed by a file path, with each path element escaped.
+func (c *client) fileURL(endpoint, p string) string {
+	var b strings.Builder
+	b.WriteString(c.baseURL + "/api/fs/" + endpoint)
+	for _, element := range strings.Split(strings.Trim(p, "/"), "/") {
+		if element != "" {
+			b.WriteString("/" + url.PathEscape(element))
+		}
+	}
+	return b.String() + "?" + url.Values{"user_id": {c.userID}}.Encode()
+}
+
+func (c *client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, &responseError{req.Method, req.URL.Path, resp.StatusCode, string(body)}
+	}
+	return resp, nil
+}
+
+func (c *client) getJSON(u string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// list returns the immediate children of a directory.
+func (c *client) list(dir string) ([]remoteFile, error) {
+	var files []remoteFile
+	err := c.getJSON(c.fileURL("list", dir), &files)
+	return files, err
+}
+
+// stat returns a file with its checksum, which listings leave out until it's been computed once.
+func (c *client) stat(p string) (remoteFile, error) {
+	var fi remoteFile
+	err := c.getJSON(c.fileURL("stat", p), &fi)
+	return fi, err
+}
+
+// walk returns the files inside a directory and its subdirectories. A missing directory has no files.
+func (c *client) walk(dir string) ([]remoteFile, error) {
+	children, err := c.list(dir)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []remoteFile
+	for _, child := range children {
+		// Paths are case-sensitive, a listing of /docs must not bring in /Docs
+		if !strings.HasPrefix(child.Path, strings.TrimSuffix(dir, "/")+"/") {
+			continue
+		}
+		if child.Type == "directory" {
+			nested, err := c.walk(child.Path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, nested...)
+			continue
+		}
+		if child.SHA256 == "" {
+			if child, err = c.stat(child.Path); err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, child)
+	}
+	return files, nil
+}
+
+// download writes the content of a file to w.
+func (c *client) download(p string, w io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, c.fileURL("files", p), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// upload creates a file, or replaces the content of an existing file, with the content of a local file.
+// The modification time of the local file is kept.
+func (c *client) upload(p, localPath string, exists bool) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The body is streamed from the file, the multipart header and trailer are written around it
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fields := map[string]string{
+			"user_id":     c.userID,
+			"modified_at": info.ModTime().UTC().Format(time.RFC3339),
+		}
+		if !exists {
+			fields["path"] = path.Dir(p)
+		}
+		for name, value := range fields {
+			if err := mw.WriteField(name, value); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		fw, err := mw.CreateFormFile("file", path.Base(p))
+		if err == nil {
+			_, err = io.Copy(fw, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	method, u := http.MethodPost, c.baseURL+"/api/fs/files"
+	if exists {
+		method, u = http.MethodPut, c.fileURL("files", p)
+	}
+	req, err := http.NewRequest(method, u, pr)
+	if err != nil {
+		_ = pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.do(req)
+	if err != nil {
+		_ = pr.Close()
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// remove moves a file to the trash. Files already gone are ignored.
+func (c *client) remove(p string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.fileURL("files", p), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// changesSince reports whether there are changes after the cursor, and returns the latest cursor.
+func (c *client) changesSince(cursor int64) (bool, int64, error) {
+	changed := false
+	for {
+		var page changesPage
+		query := url.Values{"user_id": {c.userID}, "since": {strconv.FormatInt(cursor, 10)}, "limit": {"1000"}}
+		if err := c.getJSON(c.baseURL+"/api/fs/changes.list?"+query.Encode(), &page); err != nil {
+			return changed, cursor, err
+		}
+		changed = changed || len(page.Changes) > 0
+		cursor = page.Cursor
+		if !page.HasMore {
+			return changed, cursor, nil
+		}
+	}
+}
+
+// ping checks that the server is reachable, so a wrong URL fails before anything is synced.
+func (c *client) ping() error {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/api/date.now", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
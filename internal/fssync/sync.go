@@ -0,0 +1,441 @@
+// Package fssync keeps a local directory in sync with a directory of the Files API, in both directions.
+//
+// Files are compared by their SHA-256 checksum with the checksum they had on both sides after the last
+// sync, kept in a state file in the local directory. A file changed on one side only is copied to the
+// other side, and a file deleted on one side only is deleted on the other side (remote files go to the
+// trash). When a file changed on both sides, both copies are kept: the local copy is renamed and
+// uploaded as a conflict copy, and the remote copy is downloaded in its place.
+package fssync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	stateFileName   = ".portal-sync.json"
+	tempFilePattern = ".portal-sync-*.tmp"
+)
+
+// fileState is a file as it was on both sides after the last sync. The size and modification time of
+// the local file avoid hashing it again while it's unchanged.
+type fileState struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// syncState is the state of a synced directory, saved in its state file.
+type syncState struct {
+	Server string               `json:"server"`
+	UserID string               `json:"user_id"`
+	Remote string               `json:"remote"`
+	Cursor int64                `json:"cursor"` // Change feed cursor at the start of the last sync
+	Files  map[string]fileState `json:"files"`  // Keyed by slash separated path relative to the directory
+}
+
+// Syncer syncs a local directory with a remote directory.
+type Syncer struct {
+	local  string
+	remote string
+	client *client
+	state  syncState
+}
+
+// NewSyncer returns a Syncer for a local directory, loading the state of the previous syncs if any.
+// A directory can only be synced with the remote directory it was first synced with.
+func NewSyncer(server, userID, remote, local string) (*Syncer, error) {
+	remote = path.Clean("/" + remote)
+	s := &Syncer{
+		local:  local,
+		remote: remote,
+		client: &client{baseURL: strings.TrimSuffix(server, "/"), userID: userID, http: &http.Client{}},
+		state:  syncState{Server: server, UserID: userID, Remote: remote, Files: map[string]fileState{}},
+	}
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(local, stateFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state syncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file: %w", err)
+	}
+	if state.Server != server || state.UserID != userID || state.Remote != remote {
+		return nil, fmt.Errorf("%s is synced with %s for user %s on %s", local, state.Remote, state.UserID, state.Server)
+	}
+	if state.Files == nil {
+		state.Files = map[string]fileState{}
+	}
+	s.state = state
+	return s, nil
+}
+
+func (s *Syncer) saveState() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.local, stateFileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.local, stateFileName))
+}
+
+// localPath returns the path of a file in the local directory.
+func (s *Syncer) localPath(rel string) string {
+	return filepath.Join(s.local, filepath.FromSlash(rel))
+}
+
+// remotePath returns the path of a file in the remote directory.
+func (s *Syncer) remotePath(rel string) string {
+	return path.Join(s.remote, rel)
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// scanLocal returns the files of the local directory. Checksums are only computed for files whose
+// size or modification time changed since the last sync. Symbolic links and the sync files are skipped.
+func (s *Syncer) scanLocal(hash bool) (map[string]fileState, error) {
+	files := map[string]fileState{}
+	err := filepath.WalkDir(s.local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || name == stateFileName || name == stateFileName+".tmp" {
+			return nil
+		}
+		if matched, _ := filepath.Match(tempFilePattern, name); matched {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.local, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		f := fileState{Size: info.Size(), ModTime: info.ModTime()}
+		if known, ok := s.state.Files[rel]; ok && known.Size == f.Size && known.ModTime.Equal(f.ModTime) {
+			f.SHA256 = known.SHA256
+		} else if hash {
+			if f.SHA256, err = hashFile(p); err != nil {
+				return err
+			}
+		}
+		files[rel] = f
+		return nil
+	})
+	return files, err
+}
+
+// localChanged reports whether any local file was added, removed or modified since the last sync,
+// without computing checksums.
+func (s *Syncer) localChanged() (bool, error) {
+	files, err := s.scanLocal(false)
+	if err != nil {
+		return false, err
+	}
+	if len(files) != len(s.state.Files) {
+		return true, nil
+	}
+	for rel, f := range files {
+		if f.SHA256 == "" {
+			return true, nil
+		}
+		if _, ok := s.state.Files[rel]; !ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordLocal saves the state of a local file that is now identical on both sides.
+func (s *Syncer) recordLocal(rel, sum string) error {
+	info, err := os.Stat(s.localPath(rel))
+	if err != nil {
+		return err
+	}
+	s.state.Files[rel] = fileState{SHA256: sum, Size: info.Size(), ModTime: info.ModTime()}
+	return nil
+}
+
+// download replaces a local file with the remote file, through a temporary file so an interrupted
+// download doesn't leave a partial file behind.
+func (s *Syncer) download(rel string, remote remoteFile) error {
+	dst := s.localPath(rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), tempFilePattern)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	err = s.client.download(remote.Path, tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), time.Time{}, remote.ModifiedAt); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	log.Info().Msgf("Downloaded %s", rel)
+	return s.recordLocal(rel, remote.SHA256)
+}
+
+func (s *Syncer) removeLocal(rel string) error {
+	if err := os.Remove(s.localPath(rel)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	log.Info().Msgf("Deleted %s", rel)
+	delete(s.state.Files, rel)
+	return nil
+}
+
+func (s *Syncer) removeRemote(rel string) error {
+	if err := s.client.remove(s.remotePath(rel)); err != nil {
+		return err
+	}
+	log.Info().Msgf("Deleted %s on the server", rel)
+	delete(s.state.Files, rel)
+	return nil
+}
+
+func (s *Syncer) upload(rel string, local fileState, exists bool) error {
+	if err := s.client.upload(s.remotePath(rel), s.localPath(rel), exists); err != nil {
+		return err
+	}
+	log.Info().Msgf("Uploaded %s", rel)
+	return s.recordLocal(rel, local.SHA256)
+}
+
+// conflictName returns the name of the conflict copy of a file, e.g. "notes (conflict 2025-05-10 091244).txt".
+func conflictName(rel string, now time.Time) string {
+	ext := path.Ext(rel)
+	return fmt.Sprintf("%s (conflict %s)%s", strings.TrimSuffix(rel, ext), now.Format("2006-01-02 150405"), ext)
+}
+
+// resolveConflict keeps both copies of a file changed on both sides: the local copy is renamed and
+// uploaded, and the remote copy is downloaded in its place.
+func (s *Syncer) resolveConflict(rel string, local fileState, remote remoteFile) error {
+	copyRel := conflictName(rel, time.Now())
+	if err := os.Rename(s.localPath(rel), s.localPath(copyRel)); err != nil {
+		return err
+	}
+	log.Warn().Msgf("Conflict on %s, the local copy is kept as %s", rel, copyRel)
+	if err := s.upload(copyRel, local, false); err != nil {
+		return err
+	}
+	return s.download(rel, remote)
+}
+
+// syncFile brings a file to the same content on both sides. An empty checksum means the file doesn't
+// exist on that side.
+func (s *Syncer) syncFile(rel string, local fileState, remote remoteFile) error {
+	base := s.state.Files[rel].SHA256
+	switch {
+	case local.SHA256 == remote.SHA256:
+		if local.SHA256 == "" {
+			delete(s.state.Files, rel)
+			return nil
+		}
+		return s.recordLocal(rel, local.SHA256)
+
+	case local.SHA256 == base:
+		// Unchanged locally, the server copy wins
+		if remote.SHA256 == "" {
+			return s.removeLocal(rel)
+		}
+		return s.download(rel, remote)
+
+	case remote.SHA256 == base:
+		// Unchanged on the server, the local copy wins
+		if local.SHA256 == "" {
+			return s.removeRemote(rel)
+		}
+		return s.upload(rel, local, remote.SHA256 != "")
+
+	case local.SHA256 == "":
+		// Deleted locally but changed on the server, the change is kept
+		return s.download(rel, remote)
+
+	case remote.SHA256 == "":
+		// Deleted on the server but changed locally, the change is kept
+		return s.upload(rel, local, false)
+	}
+	return s.resolveConflict(rel, local, remote)
+}
+
+// Sync runs one sync of the directories. Errors on a file are logged and the file is retried on the next sync.
+func (s *Syncer) Sync() error {
+	_, cursor, err := s.client.changesSince(s.state.Cursor)
+	if err != nil {
+		return err
+	}
+
+	localFiles, err := s.scanLocal(true)
+	if err != nil {
+		return err
+	}
+	remoteList, err := s.client.walk(s.remote)
+	if err != nil {
+		return err
+	}
+	remoteFiles := map[string]remoteFile{}
+	for _, f := range remoteList {
+		remoteFiles[strings.TrimPrefix(strings.TrimPrefix(f.Path, s.remote), "/")] = f
+	}
+
+	paths := map[string]bool{}
+	for rel := range localFiles {
+		paths[rel] = true
+	}
+	for rel := range remoteFiles {
+		paths[rel] = true
+	}
+	for rel := range s.state.Files {
+		paths[rel] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for rel := range paths {
+		sorted = append(sorted, rel)
+	}
+	sort.Strings(sorted)
+
+	failed := 0
+	for _, rel := range sorted {
+		if err := s.syncFile(rel, localFiles[rel], remoteFiles[rel]); err != nil {
+			log.Error().Err(err).Msgf("Failed to sync %s", rel)
+			failed++
+		}
+	}
+
+	s.state.Cursor = cursor
+	if err := s.saveState(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files failed to sync", failed)
+	}
+	return nil
+}
+
+// Watch syncs the directories, then syncs again whenever the change feed of the server has new changes
+// or a local file changes, checking every interval.
+func (s *Syncer) Watch(interval time.Duration) error {
+	if err := s.Sync(); err != nil {
+		log.Error().Err(err).Msg("Sync failed")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		remoteChanged, _, err := s.client.changesSince(s.state.Cursor)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to check the server for changes")
+			continue
+		}
+		localChanged, err := s.localChanged()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to check the local directory for changes")
+			continue
+		}
+		if !remoteChanged && !localChanged {
+			continue
+		}
+		if err := s.Sync(); err != nil {
+			log.Error().Err(err).Msg("Sync failed")
+		}
+	}
+	return nil
+}
+
+// Run runs the sync command with its command line arguments.
+func Run(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: portal sync [flags] <local directory>")
+		flags.PrintDefaults()
+	}
+	server := flags.String("server", envOr("PORTAL_SYNC_SERVER", "http://localhost:1323"), "URL of the portal server (PORTAL_SYNC_SERVER)")
+	userID := flags.String("user", os.Getenv("PORTAL_SYNC_USER_ID"), "ID of the user whose files are synced (PORTAL_SYNC_USER_ID)")
+	remote := flags.String("remote", "/", "Remote directory to sync with")
+	watch := flags.Bool("watch", false, "Keep running and sync again on changes")
+	interval := flags.Duration("interval", 10*time.Second, "How often to check for changes in watch mode")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *userID == "" || *interval <= 0 {
+		flags.Usage()
+		return errors.New("a local directory and a user ID are required")
+	}
+
+	s, err := NewSyncer(*server, *userID, *remote, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := s.client.ping(); err != nil {
+		return err
+	}
+	if *watch {
+		return s.Watch(*interval)
+	}
+	return s.Sync()
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
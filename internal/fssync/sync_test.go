@@ -0,0 +1,115 @@
+//go:build sqlite_fts5
+
+package fssync
+
+import (
+	"database/sql"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/sqlite3"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/labstack/echo/v4"
+
+	"github.com/Kesertki/portal/internal/handlers"
+)
+
+const testUserID = "test-user"
+
+// newTestServer serves the Files API on a database in a temporary directory.
+func newTestServer(t *testing.T) *client {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "portal.db")
+	m, err := migrate.New("file://../../db/migrations", "sqlite3://"+dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+		t.Fatal(srcErr, dbErr)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	handlers.SetupFileSystemApiHandlers(e.Group("/api"), db)
+	server := httptest.NewServer(e)
+	t.Cleanup(func() {
+		server.Close()
+		_ = db.Close()
+	})
+	return &client{baseURL: server.URL, userID: testUserID, http: &http.Client{}}
+}
+
+// uploadFile creates a remote file with the content.
+func uploadFile(t *testing.T, c *client, p, content string) {
+	t.Helper()
+	local := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(local, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.upload(p, local, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// localFiles returns the slash separated paths of the files in the local directory, without the state file.
+func localFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == stateFileName {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// Syncing /docs leaves the files of /Docs alone, on the server and locally.
+func TestSyncCaseVariantSibling(t *testing.T) {
+	c := newTestServer(t)
+	uploadFile(t, c, "/docs/a.txt", "a")
+	uploadFile(t, c, "/Docs/b.txt", "b")
+
+	local := t.TempDir()
+	s, err := NewSyncer(c.baseURL, testUserID, "/docs", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := localFiles(t, local); !reflect.DeepEqual(got, []string{"a.txt"}) {
+		t.Errorf("local files = %v, want [a.txt]", got)
+	}
+
+	// A file deleted locally is deleted on the server, only in /docs
+	if err := os.Remove(filepath.Join(local, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.stat("/docs/a.txt"); !isNotFound(err) {
+		t.Errorf("/docs/a.txt not deleted: %v", err)
+	}
+	if _, err := c.stat("/Docs/b.txt"); err != nil {
+		t.Errorf("/Docs/b.txt: %v", err)
+	}
+}
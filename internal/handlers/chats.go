@@ -2,15 +2,26 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	defaultChatsLimit = 50
+	maxChatsLimit     = 200
+)
+
 type Chat struct {
 	ID        string `json:"id"`
 	UserID    string `json:"user_id"`
@@ -22,11 +33,21 @@ type Chat struct {
 type ChatMessage struct {
 	ID         string          `json:"id"`
 	ChatID     string          `json:"chat_id"`
+	ParentID   string          `json:"parent_id,omitempty"` // Message replied to, empty for the first message
 	Sender     string          `json:"sender"`
 	SenderRole string          `json:"sender_role"`
 	Content    string          `json:"content"`
 	Timestamp  int64           `json:"timestamp"`
+	EditedAt   int64           `json:"edited_at,omitempty"`
+	Status     string          `json:"status"` // streaming while deltas are appended, then complete
 	Tools      json.RawMessage `json:"tools,omitempty"`
+	SiblingIDs []string        `json:"sibling_ids,omitempty"` // Branches at this message, including itself
+}
+
+// ChatsResponse is a page of chats. NextCursor is empty on the last page.
+type ChatsResponse struct {
+	Chats      []Chat `json:"chats"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type ChatPin struct {
@@ -45,7 +66,7 @@ type RenameChatRequest struct {
 	Title  string `json:"title"`
 }
 
-func SetupChatApiHandlers(apiGroup *echo.Group, db *sql.DB) {
+func SetupChatApiHandlers(apiGroup *echo.Group, db *sql.DB, wsHandler *WebSocketHandler) {
 	log.Info().Msg("Initializing Chat API")
 
 	apiGroup.POST("/chats.add", CreateChatHandler(db))
@@ -55,8 +76,16 @@ func SetupChatApiHandlers(apiGroup *echo.Group, db *sql.DB) {
 	apiGroup.POST("/chats.pin", PinChatHandler(db))
 	apiGroup.POST("/chats.unpin", UnpinChatHandler(db))
 	apiGroup.GET("/chats.info", GetChatInfoHandler(db))
-	apiGroup.POST("/messages.add", CreateChatMessageHandler(db))
+	apiGroup.POST("/messages.add", CreateChatMessageHandler(db, wsHandler))
+	apiGroup.POST("/messages.append", AppendMessageHandler(db, wsHandler))
+	apiGroup.POST("/messages.finish", FinishMessageHandler(db, wsHandler))
 	apiGroup.GET("/messages.list", GetChatMessagesHandler(db))
+	apiGroup.POST("/messages.update", UpdateMessageHandler(db))
+	apiGroup.POST("/messages.delete", DeleteMessageHandler(db))
+	apiGroup.GET("/messages.search", SearchMessagesHandler(db))
+	apiGroup.POST("/chats.branch", SwitchBranchHandler(db))
+	apiGroup.GET("/chats.export", ExportChatsHandler(db))
+	apiGroup.POST("/chats.import", ImportChatsHandler(db))
 }
 
 func CreateChatHandler(db *sql.DB) echo.HandlerFunc {
@@ -69,8 +98,14 @@ func CreateChatHandler(db *sql.DB) echo.HandlerFunc {
 		chat.ID = uuid.New().String()
 		chat.Timestamp = time.Now().Unix()
 
-		_, err := db.Exec("INSERT INTO chats(id, user_id, title, timestamp) VALUES(?, ?, ?, ?)",
-			chat.ID, chat.UserID, chat.Title, chat.Timestamp)
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO chats(id, user_id, title, timestamp) VALUES(?, ?, ?, ?)",
+				chat.ID, chat.UserID, chat.Title, chat.Timestamp)
+			if err != nil {
+				return err
+			}
+			return indexChat(tx, chat.ID)
+		})
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to insert chat")
 			return err
@@ -125,20 +160,18 @@ func DeleteChatHandler(db *sql.DB) echo.HandlerFunc {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 		}
 
-		result, err := db.Exec("DELETE FROM chats WHERE id = ? AND user_id = ?", deleteChatRequest.ChatID, deleteChatRequest.UserID)
-		if err != nil {
-			log.Error().Err(err).Msg("Internal server error")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-		}
-
-		rowsAffected, err := result.RowsAffected()
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := findChat(tx, deleteChatRequest.ChatID, deleteChatRequest.UserID); err != nil {
+				return err
+			}
+			if err := unindexChat(tx, deleteChatRequest.ChatID); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM chats WHERE id = ?", deleteChatRequest.ChatID)
+			return err
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("Internal server error")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-		}
-
-		if rowsAffected == 0 {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found"})
+			return respondChatError(c, err)
 		}
 
 		return c.NoContent(http.StatusOK)
@@ -153,30 +186,72 @@ func RenameChatHandler(db *sql.DB) echo.HandlerFunc {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 		}
 
-		result, err := db.Exec("UPDATE chats SET title = ? WHERE id = ? AND user_id = ?", renameChatRequest.Title, renameChatRequest.ChatID, renameChatRequest.UserID)
-		if err != nil {
-			log.Error().Err(err).Msg("Internal server error")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-		}
-
-		rowsAffected, err := result.RowsAffected()
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := findChat(tx, renameChatRequest.ChatID, renameChatRequest.UserID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE chats SET title = ? WHERE id = ?", renameChatRequest.Title, renameChatRequest.ChatID); err != nil {
+				return err
+			}
+			return indexChat(tx, renameChatRequest.ChatID)
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("Internal server error")
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-		}
-
-		if rowsAffected == 0 {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found"})
+			return respondChatError(c, err)
 		}
 
 		return c.NoContent(http.StatusOK)
 	}
 }
 
+// GetChatsHandler lists the chats of a user, pinned chats first, then by last activity.
+// Chats are filtered by title with q, and by last activity with from and to (Unix time or RFC 3339).
+// Without cursor and limit, all the chats are returned as an array, as before chats were paged.
 func GetChatsHandler(db *sql.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID := c.QueryParam("user_id")
 
+		where := []string{"c.user_id = ?"}
+		args := []any{userID}
+		if q := strings.TrimSpace(c.QueryParam("q")); q != "" {
+			where = append(where, `c.title LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+likeEscape(q)+"%")
+		}
+		for _, filter := range []struct{ param, condition string }{
+			{"from", "c.timestamp >= ?"},
+			{"to", "c.timestamp <= ?"},
+		} {
+			if value := c.QueryParam(filter.param); value != "" {
+				t, err := parseChatTime(value)
+				if err != nil {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid " + filter.param + " time"})
+				}
+				where = append(where, filter.condition)
+				args = append(args, t)
+			}
+		}
+		if value := c.QueryParam("cursor"); value != "" {
+			cursor, err := decodeChatCursor(value)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+			}
+			where = append(where, "(cp.id IS NOT NULL, c.timestamp, c.id) < (?, ?, ?)")
+			args = append(args, cursor.pinned, cursor.timestamp, cursor.id)
+		}
+		paged := c.QueryParam("cursor") != "" || c.QueryParam("limit") != ""
+		limit := defaultChatsLimit
+		if value := c.QueryParam("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+			}
+			limit = min(n, maxChatsLimit)
+		}
+
+		// One more chat than requested tells whether there is a next page, -1 is no limit
+		pageSize := limit + 1
+		if !paged {
+			pageSize = -1
+		}
 		rows, err := db.Query(`
 			SELECT
 				c.id,
@@ -192,10 +267,14 @@ func GetChatsHandler(db *sql.DB) echo.HandlerFunc {
 			LEFT JOIN
 				chats_pins cp ON c.id = cp.chat_id AND c.user_id = cp.user_id
 			WHERE
-				c.user_id = ?;
-		`, userID)
+				`+strings.Join(where, " AND ")+`
+			ORDER BY
+				is_pinned DESC, c.timestamp DESC, c.id DESC
+			LIMIT ?;
+		`, append(args, pageSize)...)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to query chats")
+			log.Error().Err(err).Msg("Failed to query chats")
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 		}
 		defer func() {
 			if err := rows.Close(); err != nil {
@@ -203,49 +282,121 @@ func GetChatsHandler(db *sql.DB) echo.HandlerFunc {
 			}
 		}()
 
-		chats := []Chat{}
+		resp := ChatsResponse{Chats: []Chat{}}
 		for rows.Next() {
 			var chat Chat
 			var isPinnedInt int
 			if err := rows.Scan(&chat.ID, &chat.UserID, &chat.Title, &chat.Timestamp, &isPinnedInt); err != nil {
 				log.Error().Err(err).Msg("Failed to scan chat")
-				return err
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 			}
 			chat.IsPinned = isPinnedInt == 1
-			chats = append(chats, chat)
+			resp.Chats = append(resp.Chats, chat)
+		}
+		if err := rows.Err(); err != nil {
+			log.Error().Err(err).Msg("Failed to query chats")
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+
+		if !paged {
+			return c.JSON(http.StatusOK, resp.Chats)
+		}
+		if len(resp.Chats) > limit {
+			resp.Chats = resp.Chats[:limit]
+			resp.NextCursor = encodeChatCursor(resp.Chats[limit-1])
 		}
 
-		return c.JSON(http.StatusOK, chats)
+		return c.JSON(http.StatusOK, resp)
 	}
 }
 
-func CreateChatMessageHandler(db *sql.DB) echo.HandlerFunc {
+// chatCursor is the position of the last chat of a page, in the order of chats.list.
+type chatCursor struct {
+	pinned    bool
+	timestamp int64
+	id        string
+}
+
+func encodeChatCursor(chat Chat) string {
+	pinned := 0
+	if chat.IsPinned {
+		pinned = 1
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%s", pinned, chat.Timestamp, chat.ID)))
+}
+
+func decodeChatCursor(s string) (chatCursor, error) {
+	var cursor chatCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, err
+	}
+	parts := strings.SplitN(string(data), ":", 3)
+	if len(parts) != 3 || (parts[0] != "0" && parts[0] != "1") {
+		return cursor, errors.New("invalid cursor")
+	}
+	cursor.pinned, cursor.id = parts[0] == "1", parts[2]
+	cursor.timestamp, err = strconv.ParseInt(parts[1], 10, 64)
+	return cursor, err
+}
+
+// parseChatTime parses a time given as Unix time, or in RFC 3339 format, to Unix time.
+func parseChatTime(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// likeEscape escapes the LIKE wildcards in s, to be used with ESCAPE '\'.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// CreateChatMessageHandler adds a message to a chat, replying to parent_id or to the active leaf.
+// The message becomes the active leaf, so a reply to an earlier message starts a new branch.
+// A message added with the streaming status is completed with messages.append and messages.finish.
+func CreateChatMessageHandler(db *sql.DB, wsHandler *WebSocketHandler) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		chatMessage := new(ChatMessage)
 		if err := c.Bind(chatMessage); err != nil {
 			return err
 		}
-
-		if chatMessage.ID == "" {
-			chatMessage.ID = uuid.New().String()
-		}
-		if chatMessage.Timestamp == 0 {
-			chatMessage.Timestamp = time.Now().Unix()
+		switch chatMessage.Status {
+		case "":
+			chatMessage.Status = messageStatusComplete
+		case messageStatusComplete, messageStatusStreaming:
+		default:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid status"})
 		}
 
-		_, err := db.Exec("INSERT INTO messages(id, chat_id, sender, sender_role, content, timestamp, tools) VALUES(?, ?, ?, ?, ?, ?, ?)",
-			chatMessage.ID, chatMessage.ChatID, chatMessage.Sender, chatMessage.SenderRole, chatMessage.Content, chatMessage.Timestamp, chatMessage.Tools)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to insert chat message")
-			return err
-		}
+		chatMessage.EditedAt, chatMessage.SiblingIDs = 0, nil
 
-		// Update chat timestamp
-		_, err = db.Exec("UPDATE chats SET timestamp = ? WHERE id = ?", chatMessage.Timestamp, chatMessage.ChatID)
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			leafID, err := findChat(tx, chatMessage.ChatID, "")
+			if err != nil {
+				return err
+			}
+			if chatMessage.ParentID == "" {
+				chatMessage.ParentID = leafID
+			}
+			return addMessage(tx, chatMessage)
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to update chat timestamp")
+			return respondChatError(c, err)
 		}
 
+		broadcastChatEvent(wsHandler, ChatEvent{
+			Type:      chatEventCreated,
+			ChatID:    chatMessage.ChatID,
+			MessageID: chatMessage.ID,
+			Message:   chatMessage,
+			Length:    utf8.RuneCountInString(chatMessage.Content),
+		})
 		return c.JSON(http.StatusCreated, chatMessage)
 	}
 }
@@ -285,36 +436,3 @@ func GetChatInfoHandler(db *sql.DB) echo.HandlerFunc {
 		return c.JSON(http.StatusOK, chat)
 	}
 }
-
-func GetChatMessagesHandler(db *sql.DB) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		chatID := c.QueryParam("chat_id")
-
-		rows, err := db.Query("SELECT id, chat_id, sender, sender_role, content, timestamp, tools FROM messages WHERE chat_id = ? ORDER BY timestamp", chatID)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to query chat messages")
-			return err
-		}
-		defer func() {
-			if err := rows.Close(); err != nil {
-				log.Error().Err(err).Msg("Error closing rows")
-			}
-		}()
-
-		messages := []ChatMessage{}
-		for rows.Next() {
-			var message ChatMessage
-			var tools []byte // Use a byte slice to scan the JSON string
-			if err := rows.Scan(&message.ID, &message.ChatID, &message.Sender, &message.SenderRole, &message.Content, &message.Timestamp, &tools); err != nil {
-				log.Error().Err(err).Msg("Failed to scan chat message")
-				return err
-			}
-			if tools != nil {
-				message.Tools = json.RawMessage(tools) // Convert the byte slice to json.RawMessage
-			}
-			messages = append(messages, message)
-		}
-
-		return c.JSON(http.StatusOK, messages)
-	}
-}
@@ -0,0 +1,495 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Chats are exported as JSON with every message of every branch, as Markdown transcripts, or as
+// OpenAI chat completions message arrays. Transcripts and message arrays hold the active branch only.
+// Imports accept the JSON export, and the conversations.json file of a ChatGPT data export. Imported
+// chats and messages get new IDs, so importing the same file twice creates copies.
+
+const (
+	chatExportVersion = 1
+
+	exportFormatJSON     = "json"
+	exportFormatMarkdown = "markdown"
+	exportFormatOpenAI   = "openai"
+)
+
+var errInvalidImport = errors.New("invalid import")
+
+// ChatExport is the JSON export of chats, also accepted by chats.import.
+type ChatExport struct {
+	Version    int            `json:"version"`
+	ExportedAt time.Time      `json:"exported_at"`
+	Chats      []ExportedChat `json:"chats"`
+}
+
+// ExportedChat is a chat with all its messages, oldest first.
+type ExportedChat struct {
+	Chat
+	ActiveLeafID string        `json:"active_leaf_id,omitempty"`
+	Messages     []ChatMessage `json:"messages"`
+}
+
+// OpenAIMessage is a message of the OpenAI chat completions API.
+type OpenAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// OpenAIConversation is the active branch of a chat as chat completions messages.
+type OpenAIConversation struct {
+	ChatID   string          `json:"chat_id"`
+	Title    string          `json:"title"`
+	Messages []OpenAIMessage `json:"messages"`
+}
+
+// ImportResult lists the chats created by an import.
+type ImportResult struct {
+	ChatIDs  []string `json:"chat_ids"`
+	Messages int      `json:"messages"`
+}
+
+// exportChats returns the chats of a user with their messages, the most recent first.
+// An empty chatIDs exports all the chats, otherwise each of them must exist.
+func exportChats(q dbtx, userID string, chatIDs []string) ([]ExportedChat, error) {
+	where, args := "c.user_id = ?", []any{userID}
+	if len(chatIDs) > 0 {
+		where += " AND c.id IN (?" + strings.Repeat(", ?", len(chatIDs)-1) + ")"
+		for _, id := range chatIDs {
+			args = append(args, id)
+		}
+	}
+	rows, err := q.Query(`
+		SELECT c.id, c.user_id, c.title, c.timestamp, cp.id IS NOT NULL, COALESCE(c.active_leaf_id, '')
+		FROM chats c
+		LEFT JOIN chats_pins cp ON c.id = cp.chat_id AND c.user_id = cp.user_id
+		WHERE `+where+`
+		ORDER BY c.timestamp DESC, c.id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	chats := []ExportedChat{}
+	for rows.Next() {
+		var chat ExportedChat
+		if err := rows.Scan(&chat.ID, &chat.UserID, &chat.Title, &chat.Timestamp, &chat.IsPinned, &chat.ActiveLeafID); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		chats = append(chats, chat)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if len(chatIDs) > 0 && len(chats) != len(chatIDs) {
+		return nil, errChatNotFound
+	}
+
+	for i := range chats {
+		ids, err := chatMessageIDs(q, chats[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		if chats[i].Messages, err = loadMessages(q, chats[i].ID, ids); err != nil {
+			return nil, err
+		}
+		// Siblings are derived from the parents
+		for j := range chats[i].Messages {
+			chats[i].Messages[j].SiblingIDs = nil
+		}
+	}
+	return chats, nil
+}
+
+// chatMessageIDs returns the IDs of all the messages of a chat, in the order they were added.
+func chatMessageIDs(q dbtx, chatID string) ([]string, error) {
+	rows, err := q.Query("SELECT id FROM messages WHERE chat_id = ? ORDER BY timestamp, rowid", chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// activeBranch returns the messages from the first message of the chat to its active leaf.
+func (chat ExportedChat) activeBranch() []ChatMessage {
+	byID := map[string]ChatMessage{}
+	for _, message := range chat.Messages {
+		byID[message.ID] = message
+	}
+	var branch []ChatMessage
+	for id := chat.ActiveLeafID; id != ""; {
+		message, ok := byID[id]
+		if !ok {
+			break
+		}
+		branch = append(branch, message)
+		delete(byID, id) // Guards against cycles in imported data
+		id = message.ParentID
+	}
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
+	return branch
+}
+
+// roleLabel returns the name of a sender role in transcripts, e.g. "Assistant".
+func roleLabel(role string) string {
+	if role == "" {
+		return "Unknown"
+	}
+	return strings.ToUpper(role[:1]) + role[1:]
+}
+
+// writeMarkdown writes the active branch of the chats as Markdown transcripts, separated by rules.
+func writeMarkdown(w io.Writer, chats []ExportedChat) error {
+	bw := bufio.NewWriter(w)
+	for i, chat := range chats {
+		if i > 0 {
+			_, _ = bw.WriteString("\n---\n\n")
+		}
+		title := chat.Title
+		if title == "" {
+			title = "Untitled chat"
+		}
+		_, _ = fmt.Fprintf(bw, "# %s\n", title)
+		for _, message := range chat.activeBranch() {
+			_, _ = fmt.Fprintf(bw, "\n**%s** · %s\n\n%s\n", roleLabel(message.SenderRole),
+				time.Unix(message.Timestamp, 0).UTC().Format("2006-01-02 15:04 MST"), strings.TrimSpace(message.Content))
+		}
+	}
+	return bw.Flush()
+}
+
+// openAIConversations returns the active branch of the chats as chat completions messages.
+func openAIConversations(chats []ExportedChat) []OpenAIConversation {
+	conversations := make([]OpenAIConversation, 0, len(chats))
+	for _, chat := range chats {
+		conversation := OpenAIConversation{ChatID: chat.ID, Title: chat.Title, Messages: []OpenAIMessage{}}
+		for _, message := range chat.activeBranch() {
+			conversation.Messages = append(conversation.Messages, OpenAIMessage{Role: message.SenderRole, Content: message.Content})
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations
+}
+
+// importChat creates a chat of a user with its messages, under new IDs. Messages replying to a message
+// missing from the chat become first messages. Without a valid active leaf, the last message is active.
+func importChat(q dbtx, userID string, chat ExportedChat) (string, error) {
+	chatID := uuid.New().String()
+	if chat.Timestamp == 0 {
+		chat.Timestamp = time.Now().Unix()
+	}
+
+	ids := map[string]string{}
+	parents := map[string]string{}
+	for _, message := range chat.Messages {
+		if _, ok := ids[message.ID]; ok || message.ID == "" {
+			return "", errInvalidImport
+		}
+		ids[message.ID] = uuid.New().String()
+		parents[message.ID] = message.ParentID
+	}
+	// Branches are walked up to their first message, which a cycle would never reach
+	rooted := map[string]bool{}
+	for id := range parents {
+		var branch []string
+		for ; id != "" && !rooted[id]; id = parents[id] {
+			if len(branch) > len(parents) {
+				return "", errInvalidImport
+			}
+			branch = append(branch, id)
+		}
+		for _, id := range branch {
+			rooted[id] = true
+		}
+	}
+	leafID, ok := ids[chat.ActiveLeafID]
+	if !ok && len(chat.Messages) > 0 {
+		leafID = ids[chat.Messages[len(chat.Messages)-1].ID]
+	}
+
+	_, err := q.Exec("INSERT INTO chats(id, user_id, title, timestamp, active_leaf_id) VALUES(?, ?, ?, ?, ?)",
+		chatID, userID, chat.Title, chat.Timestamp, sql.NullString{String: leafID, Valid: leafID != ""})
+	if err != nil {
+		return "", err
+	}
+	if err := indexChat(q, chatID); err != nil {
+		return "", err
+	}
+	if chat.IsPinned {
+		if _, err := q.Exec("INSERT INTO chats_pins(chat_id, user_id) VALUES(?, ?)", chatID, userID); err != nil {
+			return "", err
+		}
+	}
+
+	for _, message := range chat.Messages {
+		parentID := ids[message.ParentID]
+		if message.Timestamp == 0 {
+			message.Timestamp = chat.Timestamp
+		}
+		_, err := q.Exec("INSERT INTO messages(id, chat_id, parent_id, sender, sender_role, content, timestamp, edited_at, tools) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			ids[message.ID], chatID, sql.NullString{String: parentID, Valid: parentID != ""},
+			message.Sender, message.SenderRole, message.Content, message.Timestamp,
+			sql.NullInt64{Int64: message.EditedAt, Valid: message.EditedAt != 0}, message.Tools)
+		if err != nil {
+			return "", err
+		}
+		if err := indexMessage(q, ids[message.ID]); err != nil {
+			return "", err
+		}
+	}
+	return chatID, nil
+}
+
+// chatGPTConversation is a conversation of the conversations.json file of a ChatGPT data export.
+// Messages are nodes of a tree, current_node is the last message of the branch shown.
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	UpdateTime  float64                `json:"update_time"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+	CurrentNode string                 `json:"current_node"`
+}
+
+type chatGPTNode struct {
+	ID       string          `json:"id"`
+	Message  *chatGPTMessage `json:"message"`
+	Parent   string          `json:"parent"`
+	Children []string        `json:"children"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+		Text        string            `json:"text"`
+	} `json:"content"`
+	Metadata struct {
+		ModelSlug string `json:"model_slug"`
+		Hidden    bool   `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+// text returns the text of a message. Parts other than text, e.g. images, are left out.
+func (m *chatGPTMessage) text() string {
+	if m.Content.Text != "" {
+		return m.Content.Text
+	}
+	var parts []string
+	for _, raw := range m.Content.Parts {
+		var part string
+		if err := json.Unmarshal(raw, &part); err == nil && part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// chat converts the conversation to a chat of a user. Hidden and empty messages, like the system
+// message at the root of conversations, are left out, and their replies attached to their parent.
+func (conv chatGPTConversation) chat(userID string) ExportedChat {
+	chat := ExportedChat{Chat: Chat{Title: conv.Title, Timestamp: int64(conv.UpdateTime)}}
+	if chat.Timestamp == 0 {
+		chat.Timestamp = int64(conv.CreateTime)
+	}
+
+	kept := func(id string) bool {
+		node, ok := conv.Mapping[id]
+		return ok && node.Message != nil && !node.Message.Metadata.Hidden && node.Message.text() != ""
+	}
+	// keptAncestor returns the node, or its nearest ancestor, that is kept
+	keptAncestor := func(id string) string {
+		for depth := 0; id != "" && depth <= len(conv.Mapping); depth++ {
+			if kept(id) {
+				return id
+			}
+			id = conv.Mapping[id].Parent
+		}
+		return ""
+	}
+
+	for id, node := range conv.Mapping {
+		if !kept(id) {
+			continue
+		}
+		m := node.Message
+		message := ChatMessage{
+			ID:         id,
+			ParentID:   keptAncestor(node.Parent),
+			Sender:     "model:chatgpt",
+			SenderRole: m.Author.Role,
+			Content:    m.text(),
+			Timestamp:  int64(m.CreateTime),
+		}
+		if m.Metadata.ModelSlug != "" {
+			message.Sender = "model:" + m.Metadata.ModelSlug
+		}
+		if m.Author.Role == "user" {
+			message.Sender = "user:" + userID
+		}
+		if message.Timestamp == 0 {
+			message.Timestamp = int64(conv.CreateTime)
+		}
+		chat.Messages = append(chat.Messages, message)
+	}
+	sort.SliceStable(chat.Messages, func(i, j int) bool {
+		if chat.Messages[i].Timestamp != chat.Messages[j].Timestamp {
+			return chat.Messages[i].Timestamp < chat.Messages[j].Timestamp
+		}
+		return chat.Messages[i].ID < chat.Messages[j].ID
+	})
+	chat.ActiveLeafID = keptAncestor(conv.CurrentNode)
+	return chat
+}
+
+// decodeImport reads the chats of a JSON export, or of a ChatGPT conversations.json file.
+func decodeImport(r io.Reader, userID string) ([]ExportedChat, error) {
+	br := bufio.NewReader(r)
+	if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		_, _ = br.Discard(3)
+	}
+	var first byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, errInvalidImport
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			first = b
+			_ = br.UnreadByte()
+			break
+		}
+	}
+
+	if first == '[' {
+		var conversations []chatGPTConversation
+		if err := json.NewDecoder(br).Decode(&conversations); err != nil {
+			return nil, errInvalidImport
+		}
+		chats := make([]ExportedChat, 0, len(conversations))
+		for _, conv := range conversations {
+			chats = append(chats, conv.chat(userID))
+		}
+		return chats, nil
+	}
+
+	var export ChatExport
+	if err := json.NewDecoder(br).Decode(&export); err != nil || export.Version != chatExportVersion {
+		return nil, errInvalidImport
+	}
+	return export.Chats, nil
+}
+
+// ExportChatsHandler exports the chats of a user, or the chats given with chat_id, as JSON,
+// Markdown or OpenAI chat completions messages.
+func ExportChatsHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		format := c.QueryParam("format")
+		if format == "" {
+			format = exportFormatJSON
+		}
+		if format != exportFormatJSON && format != exportFormatMarkdown && format != exportFormatOpenAI {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported export format"})
+		}
+
+		chats, err := exportChats(db, c.QueryParam("user_id"), c.QueryParams()["chat_id"])
+		if err != nil {
+			return respondChatError(c, err)
+		}
+
+		switch format {
+		case exportFormatMarkdown:
+			c.Response().Header().Set(echo.HeaderContentType, "text/markdown; charset=utf-8")
+			c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="chats.md"`)
+			c.Response().WriteHeader(http.StatusOK)
+			if err := writeMarkdown(c.Response(), chats); err != nil {
+				log.Error().Err(err).Msg("Failed to write chats export")
+			}
+			return nil
+		case exportFormatOpenAI:
+			c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="chats.openai.json"`)
+			return c.JSON(http.StatusOK, openAIConversations(chats))
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="chats.json"`)
+		return c.JSON(http.StatusOK, ChatExport{Version: chatExportVersion, ExportedAt: time.Now().UTC(), Chats: chats})
+	}
+}
+
+// ImportChatsHandler imports the chats of an uploaded JSON export, or ChatGPT conversations.json file,
+// as new chats of a user. The import runs in a single transaction, an invalid file imports nothing.
+func ImportChatsHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.FormValue("user_id")
+		file, err := c.FormFile("file")
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing file"})
+		}
+		src, err := file.Open()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to open file")
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+		defer func() {
+			_ = src.Close()
+		}()
+
+		chats, err := decodeImport(src, userID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid import file"})
+		}
+
+		result := ImportResult{ChatIDs: []string{}}
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			for _, chat := range chats {
+				chatID, err := importChat(tx, userID, chat)
+				if err != nil {
+					return err
+				}
+				result.ChatIDs = append(result.ChatIDs, chatID)
+				result.Messages += len(chat.Messages)
+			}
+			return nil
+		})
+		if err == errInvalidImport {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid import file"})
+		}
+		if err != nil {
+			return respondChatError(c, err)
+		}
+
+		return c.JSON(http.StatusCreated, result)
+	}
+}
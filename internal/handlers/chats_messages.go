@@ -0,0 +1,492 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// The messages of a chat form a tree: each message replies to its parent, and messages sharing a parent
+// are branches of the conversation, e.g. regenerated replies of the assistant. The chat shows one branch
+// at a time, from the first message to its active leaf. Messages added without a parent reply to the
+// active leaf, and the added message becomes the active leaf.
+
+const (
+	defaultMessagesLimit = 100
+	maxMessagesLimit     = 500
+)
+
+var (
+	errChatNotFound    = errors.New("chat not found")
+	errMessageNotFound = errors.New("message not found")
+	errInvalidParent   = errors.New("invalid parent message")
+)
+
+// MessagesResponse is a page of the messages of a branch, oldest first.
+type MessagesResponse struct {
+	Messages []ChatMessage `json:"messages"`
+	LeafID   string        `json:"leaf_id,omitempty"` // Last message of the branch
+	HasMore  bool          `json:"has_more"`          // More messages in the direction of the page
+}
+
+type UpdateMessageRequest struct {
+	ChatID    string          `json:"chat_id"`
+	UserID    string          `json:"user_id"`
+	MessageID string          `json:"message_id"`
+	Content   *string         `json:"content"`
+	Tools     json.RawMessage `json:"tools"`
+}
+
+type DeleteMessageRequest struct {
+	ChatID    string `json:"chat_id"`
+	UserID    string `json:"user_id"`
+	MessageID string `json:"message_id"`
+}
+
+type SwitchBranchRequest struct {
+	ChatID    string `json:"chat_id"`
+	UserID    string `json:"user_id"`
+	MessageID string `json:"message_id"`
+}
+
+// respondChatError writes the JSON error response of a chat operation.
+func respondChatError(c echo.Context, err error) error {
+	switch err {
+	case errChatNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Chat not found"})
+	case errMessageNotFound:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Message not found"})
+	case errInvalidParent:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid parent message"})
+	case errNotStreaming:
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Message is not streaming"})
+	}
+	log.Error().Err(err).Msg("Chat operation failed")
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+}
+
+// findChat returns the active leaf of a chat. Chats of other users are not found, unless userID is empty.
+func findChat(q dbtx, chatID, userID string) (string, error) {
+	var leafID sql.NullString
+	err := q.QueryRow("SELECT active_leaf_id FROM chats WHERE id = ? AND (? = '' OR user_id = ?)", chatID, userID, userID).Scan(&leafID)
+	if err == sql.ErrNoRows {
+		return "", errChatNotFound
+	}
+	return leafID.String, err
+}
+
+// checkMessage returns errMessageNotFound unless the message belongs to the chat.
+func checkMessage(q dbtx, chatID, messageID string) error {
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE id = ? AND chat_id = ?)", messageID, chatID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+// latestLeaf returns the last message of the most recent branch below a message.
+func latestLeaf(q dbtx, messageID string) (string, error) {
+	for {
+		var childID string
+		err := q.QueryRow("SELECT id FROM messages WHERE parent_id = ? ORDER BY timestamp DESC, rowid DESC LIMIT 1", messageID).Scan(&childID)
+		if err == sql.ErrNoRows {
+			return messageID, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		messageID = childID
+	}
+}
+
+// branchPath returns the IDs of the messages from the first message of the chat to the leaf.
+func branchPath(q dbtx, leafID string) ([]string, error) {
+	rows, err := q.Query(`
+		WITH RECURSIVE branch(id, parent_id, depth) AS (
+			SELECT id, parent_id, 0 FROM messages WHERE id = ?
+			UNION ALL
+			SELECT m.id, m.parent_id, b.depth + 1 FROM messages m JOIN branch b ON m.id = b.parent_id
+		)
+		SELECT id FROM branch ORDER BY depth DESC`, leafID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// loadMessages returns the messages with the IDs, in the same order, along with their siblings.
+func loadMessages(q dbtx, chatID string, ids []string) ([]ChatMessage, error) {
+	if len(ids) == 0 {
+		return []ChatMessage{}, nil
+	}
+	args := []any{chatID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := q.Query(`
+		SELECT id, chat_id, parent_id, sender, sender_role, content, timestamp, edited_at, status, tools
+		FROM messages WHERE chat_id = ? AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]ChatMessage{}
+	for rows.Next() {
+		var message ChatMessage
+		var parentID sql.NullString
+		var editedAt sql.NullInt64
+		var tools []byte
+		if err := rows.Scan(&message.ID, &message.ChatID, &parentID, &message.Sender, &message.SenderRole, &message.Content, &message.Timestamp, &editedAt, &message.Status, &tools); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		message.ParentID, message.EditedAt = parentID.String, editedAt.Int64
+		if tools != nil {
+			message.Tools = json.RawMessage(tools)
+		}
+		byID[message.ID] = message
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	// Siblings are the messages sharing the parent of a message, in the order they were added
+	siblings := map[string][]string{}
+	rows, err = q.Query(`
+		SELECT id, COALESCE(parent_id, '') FROM messages
+		WHERE chat_id = ? AND COALESCE(parent_id, '') IN (SELECT COALESCE(parent_id, '') FROM messages WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`))
+		ORDER BY timestamp, rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, parentID string
+		if err := rows.Scan(&id, &parentID); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		siblings[parentID] = append(siblings[parentID], id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	messages := make([]ChatMessage, 0, len(ids))
+	for _, id := range ids {
+		message, ok := byID[id]
+		if !ok {
+			continue
+		}
+		if ids := siblings[message.ParentID]; len(ids) > 1 {
+			message.SiblingIDs = ids
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// addMessage adds a message to an existing chat, replying to its parent, and makes it the active leaf.
+// Missing IDs and timestamps are set.
+func addMessage(q dbtx, message *ChatMessage) error {
+	if message.ID == "" {
+		message.ID = uuid.New().String()
+	}
+	if message.Timestamp == 0 {
+		message.Timestamp = time.Now().Unix()
+	}
+	if message.ParentID != "" {
+		if err := checkMessage(q, message.ChatID, message.ParentID); err == errMessageNotFound {
+			return errInvalidParent
+		} else if err != nil {
+			return err
+		}
+	}
+
+	_, err := q.Exec("INSERT INTO messages(id, chat_id, parent_id, sender, sender_role, content, timestamp, status, tools) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		message.ID, message.ChatID, sql.NullString{String: message.ParentID, Valid: message.ParentID != ""},
+		message.Sender, message.SenderRole, message.Content, message.Timestamp, message.Status, message.Tools)
+	if err != nil {
+		return err
+	}
+	if err := indexMessage(q, message.ID); err != nil {
+		return err
+	}
+
+	// Update chat timestamp and active branch
+	_, err = q.Exec("UPDATE chats SET timestamp = ?, active_leaf_id = ? WHERE id = ?", message.Timestamp, message.ID, message.ChatID)
+	return err
+}
+
+// deleteMessage deletes a message with all the replies below it. If the active branch went through
+// the message, the most recent remaining branch becomes active.
+func deleteMessage(q dbtx, chatID, messageID string) error {
+	var parentID sql.NullString
+	err := q.QueryRow("SELECT parent_id FROM messages WHERE id = ? AND chat_id = ?", messageID, chatID).Scan(&parentID)
+	if err == sql.ErrNoRows {
+		return errMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var activeDeleted bool
+	err = q.QueryRow(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION ALL
+			SELECT m.id FROM messages m JOIN subtree s ON m.parent_id = s.id
+		)
+		SELECT EXISTS (SELECT 1 FROM chats WHERE id = ? AND active_leaf_id IN subtree)`, messageID, chatID).Scan(&activeDeleted)
+	if err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		"DELETE FROM message_search WHERE rowid IN (SELECT id FROM message_search_ids WHERE message_id IN subtree)",
+		"DELETE FROM message_search_ids WHERE message_id IN subtree",
+		"DELETE FROM messages WHERE id IN subtree",
+	} {
+		if _, err := q.Exec(`
+			WITH RECURSIVE subtree(id) AS (
+				SELECT ?
+				UNION ALL
+				SELECT m.id FROM messages m JOIN subtree s ON m.parent_id = s.id
+			)
+			`+statement, messageID); err != nil {
+			return err
+		}
+	}
+	if !activeDeleted {
+		return nil
+	}
+
+	var leafID sql.NullString
+	if parentID.Valid {
+		leaf, err := latestLeaf(q, parentID.String)
+		if err != nil {
+			return err
+		}
+		leafID = sql.NullString{String: leaf, Valid: true}
+	} else {
+		// A first message was deleted, the most recent remaining conversation becomes active
+		var rootID string
+		err := q.QueryRow("SELECT id FROM messages WHERE chat_id = ? AND parent_id IS NULL ORDER BY timestamp DESC, rowid DESC LIMIT 1", chatID).Scan(&rootID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			leaf, err := latestLeaf(q, rootID)
+			if err != nil {
+				return err
+			}
+			leafID = sql.NullString{String: leaf, Valid: true}
+		}
+	}
+	_, err = q.Exec("UPDATE chats SET active_leaf_id = ? WHERE id = ?", leafID, chatID)
+	return err
+}
+
+// GetChatMessagesHandler returns a page of the messages of the active branch of a chat, or of the
+// branch ending at leaf_id. Without cursor, the page holds the latest messages. before and after
+// are message IDs of the branch, returning the messages before or after them.
+// Without limit, before and after, the whole branch is returned as an array, as before messages were paged.
+func GetChatMessagesHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chatID := c.QueryParam("chat_id")
+		before, after := c.QueryParam("before"), c.QueryParam("after")
+		if before != "" && after != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Only one of before and after can be set"})
+		}
+		paged := before != "" || after != "" || c.QueryParam("limit") != ""
+		limit := defaultMessagesLimit
+		if value := c.QueryParam("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+			}
+			limit = min(n, maxMessagesLimit)
+		}
+
+		leafID, err := findChat(db, chatID, c.QueryParam("user_id"))
+		if err != nil {
+			return respondChatError(c, err)
+		}
+		if value := c.QueryParam("leaf_id"); value != "" {
+			if err := checkMessage(db, chatID, value); err != nil {
+				return respondChatError(c, err)
+			}
+			leafID = value
+		}
+
+		resp := MessagesResponse{Messages: []ChatMessage{}, LeafID: leafID}
+		if leafID == "" {
+			if !paged {
+				return c.JSON(http.StatusOK, resp.Messages)
+			}
+			return c.JSON(http.StatusOK, resp)
+		}
+		path, err := branchPath(db, leafID)
+		if err != nil {
+			return respondChatError(c, err)
+		}
+		if !paged {
+			if resp.Messages, err = loadMessages(db, chatID, path); err != nil {
+				return respondChatError(c, err)
+			}
+			return c.JSON(http.StatusOK, resp.Messages)
+		}
+
+		start, end := max(0, len(path)-limit), len(path)
+		if cursor := before + after; cursor != "" {
+			index := -1
+			for i, id := range path {
+				if id == cursor {
+					index = i
+					break
+				}
+			}
+			if index < 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+			}
+			if before != "" {
+				start, end = max(0, index-limit), index
+			} else {
+				start, end = index+1, min(len(path), index+1+limit)
+			}
+		}
+		if after != "" {
+			resp.HasMore = end < len(path)
+		} else {
+			resp.HasMore = start > 0
+		}
+
+		if resp.Messages, err = loadMessages(db, chatID, path[start:end]); err != nil {
+			return respondChatError(c, err)
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// UpdateMessageHandler edits the content or tools of a message
+func UpdateMessageHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(UpdateMessageRequest)
+		if err := c.Bind(req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+		if req.Content == nil && req.Tools == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Nothing to update"})
+		}
+
+		var message ChatMessage
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := findChat(tx, req.ChatID, req.UserID); err != nil {
+				return err
+			}
+			if err := checkMessage(tx, req.ChatID, req.MessageID); err != nil {
+				return err
+			}
+			if req.Content != nil {
+				if _, err := tx.Exec("UPDATE messages SET content = ? WHERE id = ?", *req.Content, req.MessageID); err != nil {
+					return err
+				}
+				if err := indexMessage(tx, req.MessageID); err != nil {
+					return err
+				}
+			}
+			if req.Tools != nil {
+				if _, err := tx.Exec("UPDATE messages SET tools = ? WHERE id = ?", req.Tools, req.MessageID); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.Exec("UPDATE messages SET edited_at = ? WHERE id = ?", time.Now().Unix(), req.MessageID); err != nil {
+				return err
+			}
+			messages, err := loadMessages(tx, req.ChatID, []string{req.MessageID})
+			if err == nil {
+				message = messages[0]
+			}
+			return err
+		})
+		if err != nil {
+			return respondChatError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, message)
+	}
+}
+
+// DeleteMessageHandler deletes a message along with the replies below it
+func DeleteMessageHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(DeleteMessageRequest)
+		if err := c.Bind(req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := findChat(tx, req.ChatID, req.UserID); err != nil {
+				return err
+			}
+			return deleteMessage(tx, req.ChatID, req.MessageID)
+		})
+		if err != nil {
+			return respondChatError(c, err)
+		}
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// SwitchBranchHandler makes the branch containing a message the active branch of the chat. The active
+// leaf becomes the last message of the most recent branch below the message.
+func SwitchBranchHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(SwitchBranchRequest)
+		if err := c.Bind(req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+
+		var leafID string
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := findChat(tx, req.ChatID, req.UserID); err != nil {
+				return err
+			}
+			if err := checkMessage(tx, req.ChatID, req.MessageID); err != nil {
+				return err
+			}
+			var err error
+			if leafID, err = latestLeaf(tx, req.MessageID); err != nil {
+				return err
+			}
+			_, err = tx.Exec("UPDATE chats SET active_leaf_id = ? WHERE id = ?", leafID, req.ChatID)
+			return err
+		})
+		if err != nil {
+			return respondChatError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{"leaf_id": leafID})
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// The content of messages and the titles of chats are indexed for full-text search, in the
+// message_search and chat_search tables. The rowids of the indexes are mapped to message and chat IDs by
+// message_search_ids and chat_search_ids, so an entry is updated by rowid rather than by scanning the
+// index. The handlers adding, editing and deleting messages and chats keep the indexes up to date, in the
+// transaction of the change.
+
+// MessageSearchResult is a message, or a chat title, matching a search. MessageID is empty for titles.
+type MessageSearchResult struct {
+	ChatID     string `json:"chat_id"`
+	ChatTitle  string `json:"chat_title"`
+	MessageID  string `json:"message_id,omitempty"`
+	SenderRole string `json:"sender_role,omitempty"`
+	Snippet    string `json:"snippet"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// indexMessage updates the content of a message in the search index.
+func indexMessage(q dbtx, messageID string) error {
+	var id int64
+	err := q.QueryRow(`
+		INSERT INTO message_search_ids (message_id) VALUES (?)
+		ON CONFLICT (message_id) DO UPDATE SET message_id = excluded.message_id
+		RETURNING id`, messageID).Scan(&id)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec("DELETE FROM message_search WHERE rowid = ?", id); err != nil {
+		return err
+	}
+	_, err = q.Exec("INSERT INTO message_search (rowid, content) SELECT ?, content FROM messages WHERE id = ?", id, messageID)
+	return err
+}
+
+// indexChat updates the title of a chat in the search index.
+func indexChat(q dbtx, chatID string) error {
+	var id int64
+	err := q.QueryRow(`
+		INSERT INTO chat_search_ids (chat_id) VALUES (?)
+		ON CONFLICT (chat_id) DO UPDATE SET chat_id = excluded.chat_id
+		RETURNING id`, chatID).Scan(&id)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec("DELETE FROM chat_search WHERE rowid = ?", id); err != nil {
+		return err
+	}
+	_, err = q.Exec("INSERT INTO chat_search (rowid, title) SELECT ?, title FROM chats WHERE id = ?", id, chatID)
+	return err
+}
+
+// unindexChat removes a chat and its messages from the search index, before the chat is deleted.
+func unindexChat(q dbtx, chatID string) error {
+	for _, statement := range []string{
+		"DELETE FROM message_search WHERE rowid IN (SELECT i.id FROM message_search_ids i JOIN messages m ON m.id = i.message_id WHERE m.chat_id = ?)",
+		"DELETE FROM message_search_ids WHERE message_id IN (SELECT id FROM messages WHERE chat_id = ?)",
+		"DELETE FROM chat_search WHERE rowid IN (SELECT id FROM chat_search_ids WHERE chat_id = ?)",
+		"DELETE FROM chat_search_ids WHERE chat_id = ?",
+	} {
+		if _, err := q.Exec(statement, chatID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchMessages returns the messages and chat titles of a user matching the query, best matches first.
+// Messages of all the branches of a chat are searched. An empty chatID searches all the chats.
+func searchMessages(q dbtx, userID, chatID, query string, limit int) ([]MessageSearchResult, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, errEmptyQuery
+	}
+
+	rows, err := q.Query(`
+		SELECT c.id, c.title, m.id, m.sender_role, snippet(message_search, 0, '<mark>', '</mark>', '…', 16), m.timestamp, message_search.rank
+		FROM message_search
+		JOIN message_search_ids i ON i.id = message_search.rowid
+		JOIN messages m ON m.id = i.message_id
+		JOIN chats c ON c.id = m.chat_id
+		WHERE message_search MATCH ? AND c.user_id = ? AND (? = '' OR c.id = ?)
+		UNION ALL
+		SELECT c.id, c.title, '', '', highlight(chat_search, 0, '<mark>', '</mark>'), c.timestamp, chat_search.rank
+		FROM chat_search
+		JOIN chat_search_ids i ON i.id = chat_search.rowid
+		JOIN chats c ON c.id = i.chat_id
+		WHERE chat_search MATCH ? AND c.user_id = ? AND (? = '' OR c.id = ?)
+		ORDER BY 7
+		LIMIT ?`, match, userID, chatID, chatID, match, userID, chatID, chatID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	results := []MessageSearchResult{}
+	for rows.Next() {
+		var r MessageSearchResult
+		var rank float64
+		if err := rows.Scan(&r.ChatID, &r.ChatTitle, &r.MessageID, &r.SenderRole, &r.Snippet, &r.Timestamp, &rank); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// SearchMessagesHandler handles full-text search in the chats of a user
+func SearchMessagesHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit := defaultSearchLimit
+		if value := c.QueryParam("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+			}
+			limit = min(n, maxSearchLimit)
+		}
+
+		results, err := searchMessages(db, c.QueryParam("user_id"), c.QueryParam("chat_id"), c.QueryParam("q"), limit)
+		if err == errEmptyQuery {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Empty search query"})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to search messages")
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+
+		return c.JSON(http.StatusOK, results)
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Replies of the assistant can be streamed to every open client of a chat. The producer adds the
+// message with the streaming status, appends the deltas of the content as they are generated, and
+// finishes the message. Each step is stored, so the partial content survives reconnections, and sent
+// on the "api.chats.<chat_id>" WebSocket channel. The length in events is the length of the content
+// after the event, which tells clients whether they missed a delta.
+
+const (
+	messageStatusStreaming = "streaming"
+	messageStatusComplete  = "complete"
+
+	chatEventCreated   = "message.created"
+	chatEventDelta     = "message.delta"
+	chatEventCompleted = "message.completed"
+)
+
+var errNotStreaming = errors.New("message not streaming")
+
+// ChatEvent is sent on the WebSocket channel of a chat when a message is added, streamed or finished.
+type ChatEvent struct {
+	Type      string       `json:"type"`
+	ChatID    string       `json:"chat_id"`
+	MessageID string       `json:"message_id"`
+	Message   *ChatMessage `json:"message,omitempty"` // Added or finished message
+	Delta     string       `json:"delta,omitempty"`
+	Length    int          `json:"length"` // Length of the content in characters (Unicode code points)
+}
+
+type AppendMessageRequest struct {
+	ChatID    string `json:"chat_id"`
+	UserID    string `json:"user_id"`
+	MessageID string `json:"message_id"`
+	Delta     string `json:"delta"`
+}
+
+type FinishMessageRequest struct {
+	ChatID    string          `json:"chat_id"`
+	UserID    string          `json:"user_id"`
+	MessageID string          `json:"message_id"`
+	Content   *string         `json:"content"` // Replaces the streamed content
+	Tools     json.RawMessage `json:"tools"`
+}
+
+// broadcastChatEvent sends an event on the WebSocket channel of the chat.
+func broadcastChatEvent(wsHandler *WebSocketHandler, event ChatEvent) {
+	if wsHandler == nil {
+		return
+	}
+	content, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding chat event")
+		return
+	}
+	wsHandler.BroadcastMessage("api.chats."+event.ChatID, string(content))
+}
+
+// streamingError returns errNotStreaming if the message exists but isn't streaming, errMessageNotFound otherwise.
+func streamingError(q dbtx, chatID, messageID string) error {
+	if err := checkMessage(q, chatID, messageID); err != nil {
+		return err
+	}
+	return errNotStreaming
+}
+
+// appendDelta appends a delta to the content of a streaming message, and returns the length of the content.
+func appendDelta(q dbtx, chatID, messageID, delta string) (int, error) {
+	var length int
+	err := q.QueryRow("UPDATE messages SET content = content || ? WHERE id = ? AND chat_id = ? AND status = ? RETURNING length(content)",
+		delta, messageID, chatID, messageStatusStreaming).Scan(&length)
+	if err == sql.ErrNoRows {
+		return 0, streamingError(q, chatID, messageID)
+	}
+	return length, err
+}
+
+// finishMessage completes a streaming message, replacing its content and tools unless they are nil.
+func finishMessage(q dbtx, chatID, messageID string, content *string, tools json.RawMessage) (ChatMessage, error) {
+	result, err := q.Exec("UPDATE messages SET status = ? WHERE id = ? AND chat_id = ? AND status = ?",
+		messageStatusComplete, messageID, chatID, messageStatusStreaming)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return ChatMessage{}, err
+	} else if n == 0 {
+		return ChatMessage{}, streamingError(q, chatID, messageID)
+	}
+	if content != nil {
+		if _, err := q.Exec("UPDATE messages SET content = ? WHERE id = ?", *content, messageID); err != nil {
+			return ChatMessage{}, err
+		}
+	}
+	if tools != nil {
+		if _, err := q.Exec("UPDATE messages SET tools = ? WHERE id = ?", tools, messageID); err != nil {
+			return ChatMessage{}, err
+		}
+	}
+	if _, err := q.Exec("UPDATE chats SET timestamp = ? WHERE id = ?", time.Now().Unix(), chatID); err != nil {
+		return ChatMessage{}, err
+	}
+	// Deltas aren't indexed for search, the complete content is
+	if err := indexMessage(q, messageID); err != nil {
+		return ChatMessage{}, err
+	}
+	messages, err := loadMessages(q, chatID, []string{messageID})
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	return messages[0], nil
+}
+
+// AppendMessageHandler appends a delta to the content of a streaming message
+func AppendMessageHandler(db *sql.DB, wsHandler *WebSocketHandler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(AppendMessageRequest)
+		if err := c.Bind(req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+
+		var length int
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := findChat(tx, req.ChatID, req.UserID); err != nil {
+				return err
+			}
+			var err error
+			length, err = appendDelta(tx, req.ChatID, req.MessageID, req.Delta)
+			return err
+		})
+		if err != nil {
+			return respondChatError(c, err)
+		}
+
+		if req.Delta != "" {
+			broadcastChatEvent(wsHandler, ChatEvent{
+				Type:      chatEventDelta,
+				ChatID:    req.ChatID,
+				MessageID: req.MessageID,
+				Delta:     req.Delta,
+				Length:    length,
+			})
+		}
+		return c.JSON(http.StatusOK, map[string]int{"length": length})
+	}
+}
+
+// FinishMessageHandler completes a streaming message, optionally replacing its content and tools
+func FinishMessageHandler(db *sql.DB, wsHandler *WebSocketHandler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(FinishMessageRequest)
+		if err := c.Bind(req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+
+		var message ChatMessage
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			if _, err := findChat(tx, req.ChatID, req.UserID); err != nil {
+				return err
+			}
+			var err error
+			message, err = finishMessage(tx, req.ChatID, req.MessageID, req.Content, req.Tools)
+			return err
+		})
+		if err != nil {
+			return respondChatError(c, err)
+		}
+
+		broadcastChatEvent(wsHandler, ChatEvent{
+			Type:      chatEventCompleted,
+			ChatID:    req.ChatID,
+			MessageID: req.MessageID,
+			Message:   &message,
+			Length:    utf8.RuneCountInString(message.Content),
+		})
+		return c.JSON(http.StatusOK, message)
+	}
+}
@@ -0,0 +1,502 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// The chat completions proxy forwards OpenAI compatible requests to the LLM server configured with
+// PORTAL_LLM_UPSTREAM_URL, e.g. "http://localhost:11434/v1" for Ollama. Requests with a chat ID header
+// are recorded in the chat: the request messages missing from its active branch, then the reply of the
+// model, streamed to the clients of the chat as it is generated. A request whose history differs from
+// the active branch starts a new branch where they differ, like a regenerated reply.
+
+const (
+	completionChatHeader    = "X-Portal-Chat-Id"
+	completionUserHeader    = "X-Portal-User-Id"
+	completionMessageHeader = "X-Portal-Message-Id"
+)
+
+// llmUpstream is the OpenAI compatible server the requests are forwarded to.
+type llmUpstream struct {
+	url    string
+	apiKey string
+}
+
+// loadLLMUpstream reads the upstream server from PORTAL_LLM_UPSTREAM_URL, the base URL of its API, and
+// PORTAL_LLM_UPSTREAM_API_KEY. Without API key, the Authorization header of requests is forwarded.
+func loadLLMUpstream() (llmUpstream, bool) {
+	u := llmUpstream{
+		url:    strings.TrimRight(os.Getenv("PORTAL_LLM_UPSTREAM_URL"), "/"),
+		apiKey: os.Getenv("PORTAL_LLM_UPSTREAM_API_KEY"),
+	}
+	return u, u.url != ""
+}
+
+// completionRequest is the part of a chat completions request the proxy reads, the request is forwarded as is.
+type completionRequest struct {
+	Model    string              `json:"model"`
+	Messages []completionMessage `json:"messages"`
+	Stream   bool                `json:"stream"`
+}
+
+type completionMessage struct {
+	Role       string          `json:"role"`
+	Content    json.RawMessage `json:"content"`
+	ToolCalls  json.RawMessage `json:"tool_calls"`
+	ToolCallID string          `json:"tool_call_id"`
+}
+
+type completionResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message completionMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// completionChunk is a server-sent event of a streamed chat completion.
+type completionChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string               `json:"content"`
+			ToolCalls []completionToolCall `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+// completionToolCall is a tool call of an assistant message. Streamed tool calls arrive in parts,
+// identified by their index.
+type completionToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+func SetupCompletionsProxyHandlers(group *echo.Group, db *sql.DB, wsHandler *WebSocketHandler) {
+	log.Info().Msg("Initializing chat completions proxy")
+
+	group.POST("/chat/completions", ChatCompletionsHandler(db, wsHandler))
+	group.GET("/models", ListModelsHandler())
+}
+
+// respondCompletionError writes an error in the format of the OpenAI API, which its clients understand.
+func respondCompletionError(c echo.Context, status int, message string) error {
+	return c.JSON(status, map[string]any{"error": map[string]string{"message": message, "type": "invalid_request_error"}})
+}
+
+// text returns the text of the content of a message, a string or an array of parts. Parts other than
+// text, e.g. images, are left out.
+func (m completionMessage) text() string {
+	var text string
+	if err := json.Unmarshal(m.Content, &text); err == nil {
+		return text
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(m.Content, &parts); err != nil {
+		return ""
+	}
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// tools returns the value of the tools column of a message: the tool calls of an assistant message,
+// or the tool call answered by a tool message.
+func (m completionMessage) tools() json.RawMessage {
+	var calls []json.RawMessage
+	if err := json.Unmarshal(m.ToolCalls, &calls); err == nil && len(calls) > 0 {
+		return compactJSON(m.ToolCalls)
+	}
+	if m.ToolCallID != "" {
+		tools, _ := json.Marshal([]map[string]string{{"id": m.ToolCallID}})
+		return tools
+	}
+	return nil
+}
+
+// matches reports whether a stored message is the same as the message of a request.
+// Results recorded in the tool calls by tools.invoke are ignored.
+func (m completionMessage) matches(message ChatMessage) bool {
+	return m.Role == message.SenderRole && m.text() == message.Content && sameJSON(m.tools(), withoutToolResults(message.Tools))
+}
+
+// sameJSON reports whether two JSON values are equal, whatever the order of their keys.
+func sameJSON(a, b json.RawMessage) bool {
+	a, b = compactJSON(a), compactJSON(b)
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// compactJSON removes the insignificant spaces of a JSON value. Null values are nil.
+func compactJSON(value json.RawMessage) json.RawMessage {
+	var b bytes.Buffer
+	if err := json.Compact(&b, value); err != nil {
+		return value
+	}
+	if b.Len() == 0 || b.String() == "null" {
+		return nil
+	}
+	return b.Bytes()
+}
+
+// recordRequest adds the messages of a request missing from the active branch of the chat, after the
+// longest common beginning of both. Returns the added messages, and the ID of the last message of the
+// request, to which the reply is added.
+func recordRequest(q dbtx, chatID, userID, model string, messages []completionMessage) ([]ChatMessage, string, error) {
+	leafID, err := findChat(q, chatID, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	var branch []ChatMessage
+	if leafID != "" {
+		ids, err := branchPath(q, leafID)
+		if err != nil {
+			return nil, "", err
+		}
+		if branch, err = loadMessages(q, chatID, ids); err != nil {
+			return nil, "", err
+		}
+	}
+	if userID == "" {
+		if err := q.QueryRow("SELECT user_id FROM chats WHERE id = ?", chatID).Scan(&userID); err != nil {
+			return nil, "", err
+		}
+	}
+
+	common := 0
+	for common < len(branch) && common < len(messages) && messages[common].matches(branch[common]) {
+		common++
+	}
+	parentID := ""
+	if common > 0 {
+		parentID = branch[common-1].ID
+	}
+
+	var added []ChatMessage
+	for _, m := range messages[common:] {
+		message := ChatMessage{
+			ChatID:     chatID,
+			ParentID:   parentID,
+			Sender:     "user:" + userID,
+			SenderRole: m.Role,
+			Content:    m.text(),
+			Status:     messageStatusComplete,
+			Tools:      m.tools(),
+		}
+		if m.Role == "assistant" {
+			message.Sender = "model:" + model
+		}
+		if err := addMessage(q, &message); err != nil {
+			return nil, "", err
+		}
+		added = append(added, message)
+		parentID = message.ID
+	}
+	return added, parentID, nil
+}
+
+// recordReply records a request and the reply of the model in a chat, and sends the added messages
+// to the clients of the chat. A streaming reply is recorded with an empty content.
+func recordReply(db *sql.DB, wsHandler *WebSocketHandler, chatID, userID string, req completionRequest, reply ChatMessage) (ChatMessage, error) {
+	var added []ChatMessage
+	err := inTransaction(db, func(tx *sql.Tx) error {
+		var err error
+		added, reply.ParentID, err = recordRequest(tx, chatID, userID, req.Model, req.Messages)
+		if err != nil {
+			return err
+		}
+		reply.ChatID = chatID
+		return addMessage(tx, &reply)
+	})
+	if err != nil {
+		return reply, err
+	}
+
+	for _, message := range append(added, reply) {
+		broadcastChatEvent(wsHandler, ChatEvent{
+			Type:      chatEventCreated,
+			ChatID:    chatID,
+			MessageID: message.ID,
+			Message:   &message,
+			Length:    utf8.RuneCountInString(message.Content),
+		})
+	}
+	return reply, nil
+}
+
+// forward sends a request to the upstream server, with the headers the API needs.
+func (u llmUpstream) forward(c echo.Context, method, endpoint string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c.Request().Context(), method, u.url+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	if accept := c.Request().Header.Get(echo.HeaderAccept); accept != "" {
+		req.Header.Set(echo.HeaderAccept, accept)
+	}
+	if u.apiKey != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+u.apiKey)
+	} else if auth := c.Request().Header.Get(echo.HeaderAuthorization); auth != "" {
+		req.Header.Set(echo.HeaderAuthorization, auth)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// writeHeader writes the status and the content headers of an upstream response.
+func writeHeader(c echo.Context, resp *http.Response) {
+	for _, name := range []string{echo.HeaderContentType, echo.HeaderCacheControl} {
+		if value := resp.Header.Get(name); value != "" {
+			c.Response().Header().Set(name, value)
+		}
+	}
+	c.Response().WriteHeader(resp.StatusCode)
+}
+
+// relay writes an upstream response, flushing server-sent events as they arrive.
+func relay(c echo.Context, resp *http.Response) error {
+	writeHeader(c, resp)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := c.Response().Write(buf[:n]); err != nil {
+				return nil
+			}
+			c.Response().Flush()
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// streamReply relays the server-sent events of a streamed completion, appending the content deltas to
+// the streaming reply. The reply is finished when the stream ends, even if it breaks off.
+func streamReply(c echo.Context, db *sql.DB, wsHandler *WebSocketHandler, resp *http.Response, reply ChatMessage) {
+	var content strings.Builder
+	var toolCalls []completionToolCall
+	// Deferred, so a panic while relaying doesn't leave the reply streaming
+	defer func() {
+		finishReply(db, wsHandler, reply, toolCalls)
+	}()
+
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			if _, werr := c.Response().Write([]byte(line)); werr == nil && strings.TrimSpace(line) == "" {
+				c.Response().Flush()
+			}
+		}
+
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		var chunk completionChunk
+		if ok && json.Unmarshal([]byte(data), &chunk) == nil && len(chunk.Choices) > 0 {
+			delta := chunk.Choices[0].Delta
+			if delta.Content != "" {
+				content.WriteString(delta.Content)
+				if length, err := appendDelta(db, reply.ChatID, reply.ID, delta.Content); err != nil {
+					log.Error().Err(err).Msg("Failed to record completion delta")
+				} else {
+					broadcastChatEvent(wsHandler, ChatEvent{
+						Type:      chatEventDelta,
+						ChatID:    reply.ChatID,
+						MessageID: reply.ID,
+						Delta:     delta.Content,
+						Length:    length,
+					})
+				}
+			}
+			for _, call := range delta.ToolCalls {
+				var merr error
+				if toolCalls, merr = mergeToolCall(toolCalls, call); merr != nil {
+					log.Warn().Err(merr).Msg("Ignoring invalid tool call of completion")
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	c.Response().Flush()
+}
+
+// finishReply records the tool calls of a streamed reply and marks it complete.
+func finishReply(db *sql.DB, wsHandler *WebSocketHandler, reply ChatMessage, toolCalls []completionToolCall) {
+	var tools json.RawMessage
+	if len(toolCalls) > 0 {
+		for i := range toolCalls {
+			toolCalls[i].Index = nil
+		}
+		tools, _ = json.Marshal(toolCalls)
+	}
+	var message ChatMessage
+	err := inTransaction(db, func(tx *sql.Tx) error {
+		var err error
+		message, err = finishMessage(tx, reply.ChatID, reply.ID, nil, tools)
+		return err
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to record completion")
+		return
+	}
+	broadcastChatEvent(wsHandler, ChatEvent{
+		Type:      chatEventCompleted,
+		ChatID:    message.ChatID,
+		MessageID: message.ID,
+		Message:   &message,
+		Length:    utf8.RuneCountInString(message.Content),
+	})
+}
+
+// mergeToolCall adds a part of a streamed tool call to the tool calls. The first part of a call has
+// its ID and name, the arguments are split across the parts. The index comes from the upstream server,
+// it can only be an existing call or the next one.
+func mergeToolCall(calls []completionToolCall, part completionToolCall) ([]completionToolCall, error) {
+	index := len(calls)
+	if part.Index != nil {
+		index = *part.Index
+	}
+	if index < 0 || index > len(calls) {
+		return calls, fmt.Errorf("invalid tool call index %d", index)
+	}
+	if index == len(calls) {
+		calls = append(calls, completionToolCall{Type: "function"})
+	}
+	call := &calls[index]
+	if part.ID != "" {
+		call.ID = part.ID
+	}
+	if part.Type != "" {
+		call.Type = part.Type
+	}
+	call.Function.Name += part.Function.Name
+	call.Function.Arguments += part.Function.Arguments
+	return calls, nil
+}
+
+// ChatCompletionsHandler forwards a chat completions request to the upstream server. With the
+// X-Portal-Chat-Id header, the request and the reply are recorded in the chat, and the ID of the
+// reply is returned in the X-Portal-Message-Id header.
+func ChatCompletionsHandler(db *sql.DB, wsHandler *WebSocketHandler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		upstream, ok := loadLLMUpstream()
+		if !ok {
+			return respondCompletionError(c, http.StatusServiceUnavailable, "No upstream LLM server configured")
+		}
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return respondCompletionError(c, http.StatusBadRequest, "Invalid request")
+		}
+		var req completionRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return respondCompletionError(c, http.StatusBadRequest, "Invalid request")
+		}
+
+		chatID := c.Request().Header.Get(completionChatHeader)
+		userID := c.Request().Header.Get(completionUserHeader)
+		if chatID != "" {
+			if _, err := findChat(db, chatID, userID); err == errChatNotFound {
+				return respondCompletionError(c, http.StatusNotFound, "Chat not found")
+			} else if err != nil {
+				log.Error().Err(err).Msg("Failed to find chat")
+				return respondCompletionError(c, http.StatusInternalServerError, "Internal server error")
+			}
+		}
+
+		resp, err := upstream.forward(c, http.MethodPost, "/chat/completions", body)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to call upstream LLM server")
+			return respondCompletionError(c, http.StatusBadGateway, "Upstream LLM server unavailable")
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		// Failed requests aren't recorded
+		if chatID == "" || resp.StatusCode != http.StatusOK {
+			return relay(c, resp)
+		}
+
+		reply := ChatMessage{Sender: "model:" + req.Model, SenderRole: "assistant", Status: messageStatusComplete}
+		if req.Stream {
+			reply.Status = messageStatusStreaming
+			if reply, err = recordReply(db, wsHandler, chatID, userID, req, reply); err != nil {
+				log.Error().Err(err).Msg("Failed to record completion")
+				return relay(c, resp)
+			}
+			c.Response().Header().Set(completionMessageHeader, reply.ID)
+			writeHeader(c, resp)
+			streamReply(c, db, wsHandler, resp, reply)
+			return nil
+		}
+
+		content, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return respondCompletionError(c, http.StatusBadGateway, "Upstream LLM server unavailable")
+		}
+		var completion completionResponse
+		if err := json.Unmarshal(content, &completion); err == nil && len(completion.Choices) > 0 {
+			message := completion.Choices[0].Message
+			if completion.Model != "" {
+				reply.Sender = "model:" + completion.Model
+			}
+			reply.Content, reply.Tools = message.text(), message.tools()
+			if reply, err = recordReply(db, wsHandler, chatID, userID, req, reply); err != nil {
+				log.Error().Err(err).Msg("Failed to record completion")
+			} else {
+				c.Response().Header().Set(completionMessageHeader, reply.ID)
+			}
+		}
+		return c.Blob(resp.StatusCode, resp.Header.Get(echo.HeaderContentType), content)
+	}
+}
+
+// ListModelsHandler forwards the list of models of the upstream server
+func ListModelsHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		upstream, ok := loadLLMUpstream()
+		if !ok {
+			return respondCompletionError(c, http.StatusServiceUnavailable, "No upstream LLM server configured")
+		}
+		resp, err := upstream.forward(c, http.MethodGet, "/models", nil)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to call upstream LLM server")
+			return respondCompletionError(c, http.StatusBadGateway, "Upstream LLM server unavailable")
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		return relay(c, resp)
+	}
+}
@@ -3,16 +3,60 @@ package handlers
 import (
 	"database/sql"
 	"fmt"
-	"io"
 	"net/http"
-	"path/filepath"
-	"strings"
+	"path"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 )
 
+type MoveRequest struct {
+	UserID string `json:"user_id" form:"user_id"`
+	From   string `json:"from" form:"from"`
+	To     string `json:"to" form:"to"`
+}
+
+// respondFsError writes the response for an error returned by the file store
+func respondFsError(c echo.Context, err error) error {
+	switch err {
+	case errFileNotFound:
+		return c.String(http.StatusNotFound, "File not found")
+	case errFileExists:
+		return c.String(http.StatusConflict, "File already exists")
+	case errNotDirectory:
+		return c.String(http.StatusConflict, "Not a directory")
+	case errIsDirectory:
+		return c.String(http.StatusConflict, "Is a directory")
+	case errDirectoryNotEmpty:
+		return c.String(http.StatusConflict, "Directory not empty")
+	case errInvalidPath:
+		return c.String(http.StatusBadRequest, "Invalid path")
+	case errVersionNotFound:
+		return c.String(http.StatusNotFound, "Version not found")
+	case errEmptyQuery:
+		return c.String(http.StatusBadRequest, "Missing search query")
+	case errNotText:
+		return c.String(http.StatusUnprocessableEntity, "Only text files up to 1MB can be compared")
+	case errInvalidArchive:
+		return c.String(http.StatusBadRequest, "Invalid archive")
+	case errArchiveTooLarge:
+		return c.String(http.StatusRequestEntityTooLarge, "Archive exceeds the extraction limits")
+	case errInvalidMetadata:
+		return c.String(http.StatusBadRequest, "Invalid metadata")
+	case errNoPreview:
+		return c.String(http.StatusUnsupportedMediaType, "No preview available for this file")
+	case errPreviewTooLarge:
+		return c.String(http.StatusUnprocessableEntity, "File too large to preview")
+	case errInvalidPreviewSize:
+		return c.String(http.StatusBadRequest, "Invalid preview size")
+	case errReadOnly:
+		return c.String(http.StatusForbidden, "Read-only file system")
+	}
+	log.Error().Err(err).Msg("File system operation failed")
+	return c.String(http.StatusInternalServerError, "Internal Server Error")
+}
+
 // CreateFileHandler handles file creation
 func CreateFileHandler(db *sql.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -34,123 +78,96 @@ func CreateFileHandler(db *sql.DB) echo.HandlerFunc {
 		}()
 
 		userID := c.FormValue("user_id")
-		filePath := filepath.Join(c.FormValue("path"), file.Filename)
-		fileSize := file.Size
-
-		// Ensure the path has a leading slash
-		if !strings.HasPrefix(filePath, "/") {
-			filePath = "/" + filePath
-		}
-
-		tx, err := db.Begin()
+		filePath := normalizePath(path.Join(c.FormValue("path"), file.Filename))
+		metadata, err := parseMetadataForm(c)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to start transaction")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
+			return respondFsError(c, err)
 		}
-		rollback(tx)
 
-		res, err := tx.Exec("INSERT INTO files (user_id, path, filename, size) VALUES (?, ?, ?, ?)", userID, filePath, file.Filename, fileSize)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to insert file metadata")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
-		}
-
-		fileID, err := res.LastInsertId()
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to get last insert ID")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
-		}
-
-		chunkSize := 1024 * 1024 // 1MB chunks
-		chunkIndex := 0
-		buffer := make([]byte, chunkSize)
-
-		for {
-			n, err := src.Read(buffer)
-			if err != nil && err != io.EOF {
-				log.Error().Err(err).Msg("Failed to read file content")
-				return c.String(http.StatusInternalServerError, "Internal Server Error")
-			}
-			if n == 0 {
-				break
-			}
-
-			_, err = tx.Exec("INSERT INTO file_content (file_id, chunk_index, content) VALUES (?, ?, ?)", fileID, chunkIndex, buffer[:n])
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			fileID, err := createFile(tx, userID, filePath, src)
 			if err != nil {
-				log.Error().Err(err).Msg("Failed to insert file content")
-				return c.String(http.StatusInternalServerError, "Internal Server Error")
+				return err
 			}
-			chunkIndex++
-		}
-
-		if err := tx.Commit(); err != nil {
-			log.Error().Err(err).Msg("Failed to commit transaction")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
+			return updateFileMetadata(tx, fileID, metadata)
+		})
+		if err != nil {
+			return respondFsError(c, err)
 		}
 
 		return c.String(http.StatusOK, "File created successfully")
 	}
 }
 
-// ReadFileHandler handles file reading
+// ReadFileHandler handles file reading. It supports range requests and conditional requests
+// (If-None-Match, If-Modified-Since, If-Range), using the SHA-256 of the content as strong ETag.
+// The content type is the MIME type stored with the file.
+// A previous version of the file is returned with the "version" query parameter.
 func ReadFileHandler(db *sql.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID := c.QueryParam("user_id")
-		filePath := c.Param("*")
-
-		// Ensure the path has a leading slash
-		if !strings.HasPrefix(filePath, "/") {
-			filePath = "/" + filePath
-		}
+		filePath := normalizePath(c.Param("*"))
 
 		log.Info().Msgf("Reading file for userID: %s, filePath: %s", userID, filePath)
 
-		var fileID int64
-		err := db.QueryRow("SELECT id FROM files WHERE user_id = ? AND path = ?", userID, filePath).Scan(&fileID)
-		if err != nil {
-			log.Error().Err(err).Msg("File not found")
-			return c.String(http.StatusNotFound, "File not found")
+		if m, rel, ok := findMount(filePath); ok {
+			return serveMountedFile(c, m, rel)
 		}
-		log.Info().Msgf("File ID: %d", fileID)
 
-		rows, err := db.Query("SELECT content FROM file_content WHERE file_id = ? ORDER BY chunk_index", fileID)
+		fi, err := statPath(db, userID, filePath)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to get file content")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
+			return respondFsError(c, err)
+		}
+		if fi.IsDir() {
+			return respondFsError(c, errIsDirectory)
 		}
-		defer func() {
-			if err := rows.Close(); err != nil {
-				log.Error().Err(err).Msg("Error closing rows")
-			}
-		}()
 
-		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEOctetStream)
-		for rows.Next() {
-			var chunk []byte
-			if err := rows.Scan(&chunk); err != nil {
-				log.Error().Err(err).Msg("Failed to scan file content")
-				return c.String(http.StatusInternalServerError, "Internal Server Error")
+		// Previous versions are read from the files row holding their content
+		contentID, modTime := fi.id, fi.ModifiedAt
+		if c.QueryParam("version") != "" {
+			version, err := parseVersion(c.QueryParam("version"))
+			if err != nil {
+				return respondFsError(c, err)
 			}
-			if _, err := c.Response().Write(chunk); err != nil {
-				log.Error().Err(err).Msg("Failed to write file content")
-				return err
+			v, err := findFileVersion(db, fi.id, version)
+			if err != nil {
+				return respondFsError(c, err)
 			}
+			contentID, modTime = v.contentID, v.CreatedAt
 		}
 
-		return nil
+		return serveFileContent(c, db, fi.Name, contentID, modTime)
 	}
 }
 
+// serveFileContent writes the content of a file, handling range and conditional requests
+func serveFileContent(c echo.Context, q dbtx, name string, contentID int64, modTime time.Time) error {
+	sum, err := fileChecksum(q, contentID)
+	if err != nil {
+		return respondFsError(c, err)
+	}
+	var mimeType sql.NullString
+	if err := q.QueryRow("SELECT mime_type FROM files WHERE id = ?", contentID).Scan(&mimeType); err != nil {
+		return respondFsError(c, err)
+	}
+	content, err := openFileContent(q, contentID)
+	if err != nil {
+		return respondFsError(c, err)
+	}
+
+	c.Response().Header().Set("ETag", `"`+sum+`"`)
+	if mimeType.Valid {
+		c.Response().Header().Set(echo.HeaderContentType, mimeType.String)
+	}
+	http.ServeContent(c.Response(), c.Request(), name, modTime, content)
+	return nil
+}
+
 // UpdateFileHandler handles file updating
 func UpdateFileHandler(db *sql.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID := c.FormValue("user_id")
-		filePath := c.Param("*")
-
-		// Ensure the path has a leading slash
-		if !strings.HasPrefix(filePath, "/") {
-			filePath = "/" + filePath
-		}
+		filePath := normalizePath(c.Param("*"))
 
 		file, err := c.FormFile("file")
 		if err != nil {
@@ -169,125 +186,167 @@ func UpdateFileHandler(db *sql.DB) echo.HandlerFunc {
 			}
 		}()
 
-		var fileID int64
-		err = db.QueryRow("SELECT id FROM files WHERE user_id = ? AND path = ?", userID, filePath).Scan(&fileID)
+		metadata, err := parseMetadataForm(c)
 		if err != nil {
-			log.Error().Err(err).Msg("File not found")
-			return c.String(http.StatusNotFound, "File not found")
+			return respondFsError(c, err)
 		}
 
-		// Delete existing content
-		_, err = db.Exec("DELETE FROM file_content WHERE file_id = ?", fileID)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to delete file content")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
+		if err := checkWritable(filePath); err != nil {
+			return respondFsError(c, err)
 		}
 
-		// Insert new file content in chunks
-		chunkSize := 1024 * 1024 // 1MB chunks
-		chunkIndex := 0
-		buffer := make([]byte, chunkSize)
-
-		for {
-			n, err := src.Read(buffer)
-			if err != nil && err != io.EOF {
-				log.Error().Err(err).Msg("Failed to read file content")
-				return c.String(http.StatusInternalServerError, "Internal Server Error")
-			}
-			if n == 0 {
-				break
-			}
-
-			_, err = db.Exec("INSERT INTO file_content (file_id, chunk_index, content) VALUES (?, ?, ?)", fileID, chunkIndex, buffer[:n])
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			fileID, err := findFile(tx, userID, filePath)
 			if err != nil {
-				log.Error().Err(err).Msg("Failed to insert file content")
-				return c.String(http.StatusInternalServerError, "Internal Server Error")
+				return err
 			}
-			chunkIndex++
-		}
-
-		// Update file metadata
-		_, err = db.Exec("UPDATE files SET size = ?, created_at = ? WHERE id = ?", file.Size, time.Now(), fileID)
+			if err := replaceFileContent(tx, fileID, src); err != nil {
+				return err
+			}
+			return updateFileMetadata(tx, fileID, metadata)
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to update file metadata")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
+			return respondFsError(c, err)
 		}
 
 		return c.String(http.StatusOK, "File updated successfully")
 	}
 }
 
-// DeleteFileHandler handles file deletion
+// DeleteFileHandler handles file deletion. Files are moved to the trash, unless permanent is set.
 func DeleteFileHandler(db *sql.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID := c.QueryParam("user_id")
-		filePath := c.Param("*")
+		filePath := normalizePath(c.Param("*"))
+		permanent := c.QueryParam("permanent") == "true"
 
-		// Ensure the path has a leading slash
-		if !strings.HasPrefix(filePath, "/") {
-			filePath = "/" + filePath
+		if err := checkWritable(filePath); err != nil {
+			return respondFsError(c, err)
 		}
 
-		var fileID int64
-		err := db.QueryRow("SELECT id FROM files WHERE user_id = ? AND path = ?", userID, filePath).Scan(&fileID)
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			fileID, err := findFile(tx, userID, filePath)
+			if err != nil {
+				return err
+			}
+			if permanent {
+				return deleteFileByID(tx, fileID)
+			}
+			_, err = trashPath(tx, userID, filePath)
+			return err
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("File not found")
-			return c.String(http.StatusNotFound, "File not found")
+			return respondFsError(c, err)
 		}
 
-		_, err = db.Exec("DELETE FROM file_content WHERE file_id = ?", fileID)
+		return c.String(http.StatusOK, "File deleted successfully")
+	}
+}
+
+// ListDirectoryHandler handles directory listing, returning the immediate children of the directory,
+// including the mounts inside it
+func ListDirectoryHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		dirPath := normalizePath(c.Param("*"))
+
+		files, err := listWithMounts(db, userID, dirPath)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to delete file content")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
+			return respondFsError(c, err)
 		}
 
-		_, err = db.Exec("DELETE FROM files WHERE id = ?", fileID)
+		return c.JSON(http.StatusOK, files)
+	}
+}
+
+// MakeDirectoryHandler handles directory creation
+func MakeDirectoryHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.FormValue("user_id")
+		dirPath := normalizePath(c.Param("*"))
+		parents := c.FormValue("parents") == "true"
+
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			return makeDirectory(tx, userID, dirPath, parents)
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to delete file metadata")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
+			return respondFsError(c, err)
 		}
 
-		return c.String(http.StatusOK, "File deleted successfully")
+		return c.String(http.StatusCreated, "Directory created successfully")
 	}
 }
 
-// ListDirectoryHandler handles directory listing
-func ListDirectoryHandler(db *sql.DB) echo.HandlerFunc {
+// RemoveDirectoryHandler handles directory deletion. Directories are moved to the trash, unless permanent is set.
+func RemoveDirectoryHandler(db *sql.DB) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		userID := c.QueryParam("user_id")
-		dirPath := c.Param("*")
+		dirPath := normalizePath(c.Param("*"))
+		recursive := c.QueryParam("recursive") == "true"
+		permanent := c.QueryParam("permanent") == "true"
 
-		// Ensure the path has a leading slash
-		if !strings.HasPrefix(dirPath, "/") {
-			dirPath = "/" + dirPath
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			fi, err := statPath(tx, userID, dirPath)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return errNotDirectory
+			}
+			if permanent {
+				return removePath(tx, userID, dirPath, recursive)
+			}
+			if !recursive {
+				if err := checkDirectoryEmpty(tx, userID, dirPath); err != nil {
+					return err
+				}
+			}
+			_, err = trashPath(tx, userID, dirPath)
+			return err
+		})
+		if err != nil {
+			return respondFsError(c, err)
 		}
 
-		// Ensure the path ends with a slash to denote a directory
-		if !strings.HasSuffix(dirPath, "/") {
-			dirPath += "/"
+		return c.String(http.StatusOK, "Directory deleted successfully")
+	}
+}
+
+// MoveHandler handles moving and renaming files and directories
+func MoveHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(MoveRequest)
+		if err := c.Bind(req); err != nil || req.From == "" || req.To == "" {
+			return c.String(http.StatusBadRequest, "Bad Request")
 		}
 
-		rows, err := db.Query("SELECT filename FROM files WHERE user_id = ? AND path LIKE ?", userID, dirPath+"%")
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			return movePath(tx, req.UserID, normalizePath(req.From), normalizePath(req.To))
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to list directory")
-			return c.String(http.StatusInternalServerError, "Internal Server Error")
+			return respondFsError(c, err)
 		}
-		defer func() {
-			if err := rows.Close(); err != nil {
-				log.Error().Err(err).Msg("Error closing rows")
-			}
-		}()
 
-		var files []string
-		for rows.Next() {
-			var filename string
-			if err := rows.Scan(&filename); err != nil {
-				return c.String(http.StatusInternalServerError, "Internal Server Error")
-			}
-			files = append(files, filename)
+		return c.String(http.StatusOK, "Moved successfully")
+	}
+}
+
+// CopyHandler handles copying files and directories
+func CopyHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(MoveRequest)
+		if err := c.Bind(req); err != nil || req.From == "" || req.To == "" {
+			return c.String(http.StatusBadRequest, "Bad Request")
 		}
 
-		return c.JSON(http.StatusOK, files)
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			return copyPath(tx, req.UserID, normalizePath(req.From), normalizePath(req.To))
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.String(http.StatusOK, "Copied successfully")
 	}
 }
 
@@ -295,10 +354,43 @@ func ListDirectoryHandler(db *sql.DB) echo.HandlerFunc {
 func SetupFileSystemApiHandlers(apiGroup *echo.Group, db *sql.DB) {
 	log.Info().Msg("Initializing File System API")
 
+	go indexMissingFiles(db)
+
 	fsGroup := apiGroup.Group("/fs")
 	fsGroup.POST("/files", CreateFileHandler(db))
 	fsGroup.GET("/files/*", ReadFileHandler(db))
+	fsGroup.HEAD("/files/*", ReadFileHandler(db))
 	fsGroup.PUT("/files/*", UpdateFileHandler(db))
+	fsGroup.PATCH("/files/*", UpdateMetadataHandler(db))
 	fsGroup.DELETE("/files/*", DeleteFileHandler(db))
+	fsGroup.GET("/list", ListDirectoryHandler(db))
 	fsGroup.GET("/list/*", ListDirectoryHandler(db))
+	fsGroup.GET("/stat", StatHandler(db))
+	fsGroup.GET("/stat/*", StatHandler(db))
+	fsGroup.GET("/preview/*", FilePreviewHandler(db))
+	fsGroup.GET("/changes.list", ListChangesHandler(db))
+	fsGroup.POST("/dirs/*", MakeDirectoryHandler(db))
+	fsGroup.DELETE("/dirs/*", RemoveDirectoryHandler(db))
+	fsGroup.POST("/move", MoveHandler(db))
+	fsGroup.POST("/copy", CopyHandler(db))
+	fsGroup.GET("/archive", DownloadArchiveHandler(db))
+	fsGroup.GET("/archive/*", DownloadArchiveHandler(db))
+	fsGroup.POST("/extract", ExtractArchiveHandler(db))
+	fsGroup.POST("/extract/*", ExtractArchiveHandler(db))
+	fsGroup.GET("/versions/*", ListVersionsHandler(db))
+	fsGroup.POST("/restore/*", RestoreVersionHandler(db))
+	fsGroup.GET("/diff/*", DiffVersionsHandler(db))
+	fsGroup.GET("/search", SearchFilesHandler(db))
+	fsGroup.POST("/shares", CreateShareHandler(db))
+	fsGroup.GET("/shares", ListSharesHandler(db))
+	fsGroup.DELETE("/shares/:token", DeleteShareHandler(db))
+	fsGroup.GET("/trash", ListTrashHandler(db))
+	fsGroup.DELETE("/trash", EmptyTrashHandler(db))
+	fsGroup.POST("/trash/:id/restore", RestoreTrashHandler(db))
+	fsGroup.DELETE("/trash/:id", DeleteTrashItemHandler(db))
+	fsGroup.OPTIONS("/uploads", UploadOptionsHandler)
+	fsGroup.POST("/uploads", CreateUploadHandler(db))
+	fsGroup.HEAD("/uploads/:id", UploadOffsetHandler(db))
+	fsGroup.PATCH("/uploads/:id", UploadChunkHandler(db))
+	fsGroup.DELETE("/uploads/:id", DeleteUploadHandler(db))
 }
@@ -0,0 +1,391 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Directories are downloaded as zip or tar.gz archives streamed from the stored chunks, and zip, tar
+// and tar.gz archives are extracted into a directory. Extraction runs in a single transaction, so a
+// rejected archive leaves no partial content behind.
+
+const (
+	archiveFormatZip   = "zip"
+	archiveFormatTarGz = "tar.gz"
+
+	defaultExtractMaxSize  = 1 << 30 // 1GB
+	defaultExtractMaxFiles = 10000
+)
+
+var (
+	errInvalidArchive  = errors.New("invalid archive")
+	errArchiveTooLarge = errors.New("archive too large")
+)
+
+// ExtractResult summarizes the content extracted from an archive.
+type ExtractResult struct {
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+// extractLimits bounds the content extracted from an archive, whatever its headers claim.
+type extractLimits struct {
+	maxSize  int64
+	maxFiles int
+}
+
+// loadExtractLimits reads the extraction limits from PORTAL_FS_EXTRACT_MAX_SIZE (bytes) and PORTAL_FS_EXTRACT_MAX_FILES.
+func loadExtractLimits() extractLimits {
+	limits := extractLimits{maxSize: defaultExtractMaxSize, maxFiles: defaultExtractMaxFiles}
+	if n, err := strconv.ParseInt(os.Getenv("PORTAL_FS_EXTRACT_MAX_SIZE"), 10, 64); err == nil && n > 0 {
+		limits.maxSize = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PORTAL_FS_EXTRACT_MAX_FILES")); err == nil && n > 0 {
+		limits.maxFiles = n
+	}
+	return limits
+}
+
+// archiveEntryName returns the name of a file or directory in an archive of dir.
+// Entries are placed in a top level directory named after dir.
+func archiveEntryName(dir, p string) string {
+	root := path.Base(dir)
+	if dir == "/" {
+		root = "files"
+	}
+	return strings.TrimSuffix(root+strings.TrimPrefix(p, strings.TrimSuffix(dir, "/")), "/")
+}
+
+// entriesInside drops the files and directories that are not inside dir, which can't be named in its archive.
+func entriesInside(entries []FileInfo, dir string) []FileInfo {
+	inside := entries[:0]
+	for _, e := range entries {
+		if isInside(e.Path, dir) {
+			inside = append(inside, e)
+		}
+	}
+	return inside
+}
+
+// writeZipArchive writes the directories and files inside dir to a zip archive.
+func writeZipArchive(w io.Writer, q dbtx, dir string, dirs, files []FileInfo) error {
+	zw := zip.NewWriter(w)
+	for _, d := range dirs {
+		header := &zip.FileHeader{Name: archiveEntryName(dir, d.Path) + "/", Modified: d.ModifiedAt}
+		header.SetMode(os.ModeDir | 0755)
+		if _, err := zw.CreateHeader(header); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		header := &zip.FileHeader{Name: archiveEntryName(dir, f.Path), Method: zip.Deflate, Modified: f.ModifiedAt}
+		header.SetMode(0644)
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, fileContentReader(q, f.id)); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGzArchive writes the directories and files inside dir to a gzip compressed tar archive.
+func writeTarGzArchive(w io.Writer, q dbtx, dir string, dirs, files []FileInfo) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, d := range dirs {
+		header := &tar.Header{Typeflag: tar.TypeDir, Name: archiveEntryName(dir, d.Path) + "/", Mode: 0755, ModTime: d.ModifiedAt}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: archiveEntryName(dir, f.Path), Size: f.Size, Mode: 0644, ModTime: f.ModifiedAt}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, fileContentReader(q, f.id)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// extractPath returns the path of an archive entry extracted into dir. Entries with absolute paths
+// or ".." elements are rejected instead of being cleaned, so they can't be written outside of dir.
+func extractPath(dir, name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", errInvalidArchive
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "", errInvalidArchive
+		}
+	}
+	p := path.Join(dir, name)
+	if !isInside(p, dir) {
+		return "", errInvalidArchive
+	}
+	return p, nil
+}
+
+// archiveExtractor writes the entries of an archive into a directory of a user.
+type archiveExtractor struct {
+	q         dbtx
+	userID    string
+	dir       string
+	overwrite bool
+	limits    extractLimits
+	result    ExtractResult
+}
+
+// extractReader counts the bytes extracted from the entries, failing as soon as the size limit is exceeded.
+// Errors reading the entries, e.g. corrupted data, are reported as invalid archive.
+type extractReader struct {
+	r io.Reader
+	e *archiveExtractor
+}
+
+func (r extractReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.e.result.Size += int64(n)
+	if r.e.result.Size > r.e.limits.maxSize {
+		return n, errArchiveTooLarge
+	}
+	if err != nil && err != io.EOF {
+		return n, errInvalidArchive
+	}
+	return n, err
+}
+
+func (e *archiveExtractor) mkdir(name string) error {
+	p, err := extractPath(e.dir, name)
+	if err != nil || p == e.dir {
+		return err
+	}
+	return ensureDirectories(e.q, e.userID, p)
+}
+
+func (e *archiveExtractor) writeFile(name string, r io.Reader) error {
+	p, err := extractPath(e.dir, name)
+	if err != nil {
+		return err
+	}
+	if p == e.dir {
+		return errInvalidArchive
+	}
+	e.result.Files++
+	if e.result.Files > e.limits.maxFiles {
+		return errArchiveTooLarge
+	}
+
+	r = extractReader{r: r, e: e}
+	fi, err := statPath(e.q, e.userID, p)
+	if err == errFileNotFound {
+		_, err = createFile(e.q, e.userID, p, r)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errIsDirectory
+	}
+	if !e.overwrite {
+		return errFileExists
+	}
+	return replaceFileContent(e.q, fi.id, r)
+}
+
+// extractZip extracts a zip archive. Entries other than files and directories, e.g. symbolic links, are skipped.
+func (e *archiveExtractor) extractZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return errInvalidArchive
+	}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if mode.IsDir() {
+			if err := e.mkdir(f.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return errInvalidArchive
+		}
+		err = e.writeFile(f.Name, rc)
+		if cerr := rc.Close(); err == nil && cerr != nil {
+			err = errInvalidArchive
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTar extracts a tar archive. Entries other than files and directories, e.g. symbolic links, are skipped.
+func (e *archiveExtractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errInvalidArchive
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(header.Name)
+		case tar.TypeReg:
+			err = e.writeFile(header.Name, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extract detects the format of the archive from its first bytes and extracts it.
+func (e *archiveExtractor) extract(archive io.ReaderAt, size int64) error {
+	if err := ensureDirectories(e.q, e.userID, e.dir); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(archive, 0, size))
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return e.extractZip(archive, size)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return errInvalidArchive
+		}
+		return e.extractTar(gr)
+	}
+	return e.extractTar(br)
+}
+
+// DownloadArchiveHandler streams a directory as a zip archive, or as a tar.gz archive with format=tar.gz
+func DownloadArchiveHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		dirPath := normalizePath(c.Param("*"))
+		format := c.QueryParam("format")
+		if format == "" {
+			format = archiveFormatZip
+		}
+		if format != archiveFormatZip && format != archiveFormatTarGz {
+			return c.String(http.StatusBadRequest, "Unsupported archive format")
+		}
+
+		fi, err := statPath(db, userID, dirPath)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		if !fi.IsDir() {
+			return respondFsError(c, errNotDirectory)
+		}
+		dirs, err := walkDirectories(db, userID, dirPath)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		dirs = append([]FileInfo{fi}, entriesInside(dirs, dirPath)...)
+		files, err := walkFiles(db, userID, dirPath)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		files = entriesInside(files, dirPath)
+
+		filename := archiveEntryName(dirPath, dirPath) + "." + format
+		contentType := "application/zip"
+		if format == archiveFormatTarGz {
+			contentType = "application/gzip"
+		}
+		c.Response().Header().Set(echo.HeaderContentType, contentType)
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+		c.Response().WriteHeader(http.StatusOK)
+
+		// The status is already sent, errors can only be logged
+		if format == archiveFormatTarGz {
+			err = writeTarGzArchive(c.Response(), db, dirPath, dirs, files)
+		} else {
+			err = writeZipArchive(c.Response(), db, dirPath, dirs, files)
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to write archive of %s", dirPath)
+		}
+		return nil
+	}
+}
+
+// ExtractArchiveHandler extracts an uploaded zip, tar or tar.gz archive into a directory.
+// Existing files are only replaced with overwrite=true, keeping their previous content as a version.
+func ExtractArchiveHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		file, err := c.FormFile("file")
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to bind file")
+			return c.String(http.StatusBadRequest, "Bad Request")
+		}
+
+		src, err := file.Open()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to open file")
+			return c.String(http.StatusInternalServerError, "Internal Server Error")
+		}
+		defer func() {
+			if cerr := src.Close(); cerr != nil {
+				fmt.Printf("Error closing file: %v\n", cerr)
+			}
+		}()
+
+		e := &archiveExtractor{
+			userID:    c.FormValue("user_id"),
+			dir:       normalizePath(c.Param("*")),
+			overwrite: c.FormValue("overwrite") == "true",
+			limits:    loadExtractLimits(),
+		}
+		e.result.Path = e.dir
+
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			e.q = tx
+			return e.extract(src, file.Size)
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, e.result)
+	}
+}
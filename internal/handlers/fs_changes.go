@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Every change to the files and directories of a user is recorded in the fs_changes table, in the
+// same transaction as the change. Clients catch up with the change feed from the last cursor they
+// have seen, and receive new changes on the "api.fs.<user_id>" WebSocket channel.
+
+const (
+	changeCreate = "create"
+	changeUpdate = "update"
+	changeDelete = "delete"
+	changeMove   = "move"
+
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// FileChange is a change to a file or directory. Changes to a directory apply to everything inside it.
+type FileChange struct {
+	Cursor    int64     `json:"cursor"`
+	Action    string    `json:"action"` // "create" | "update" | "delete" | "move"
+	Type      string    `json:"type"`   // "file" | "directory"
+	Path      string    `json:"path"`
+	OldPath   string    `json:"old_path,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	userID string
+}
+
+// ChangesResponse is a page of the change feed.
+type ChangesResponse struct {
+	Changes []FileChange `json:"changes"`
+	Cursor  int64        `json:"cursor"` // Cursor to request the next changes from
+	HasMore bool         `json:"has_more"`
+}
+
+// recordChange adds a change to the change feed of a user. Changes to internal paths are ignored.
+func recordChange(q dbtx, userID, action, fileType, p, oldPath string) error {
+	if !strings.HasPrefix(p, "/") {
+		return nil
+	}
+	_, err := q.Exec("INSERT INTO fs_changes (user_id, action, type, path, old_path, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, action, fileType, p, sql.NullString{String: oldPath, Valid: oldPath != ""}, time.Now())
+	return err
+}
+
+// recordFileChange adds a change to the file with the ID to the change feed of its user.
+func recordFileChange(q dbtx, fileID int64, action string) error {
+	var userID, p string
+	if err := q.QueryRow("SELECT user_id, path FROM files WHERE id = ?", fileID).Scan(&userID, &p); err != nil {
+		return err
+	}
+	return recordChange(q, userID, action, fileTypeFile, p, "")
+}
+
+func scanChanges(rows *sql.Rows) ([]FileChange, error) {
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	changes := []FileChange{}
+	for rows.Next() {
+		var change FileChange
+		var oldPath sql.NullString
+		if err := rows.Scan(&change.Cursor, &change.userID, &change.Action, &change.Type, &change.Path, &oldPath, &change.CreatedAt); err != nil {
+			return nil, err
+		}
+		change.OldPath = oldPath.String
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// listChanges returns the changes of a user after the cursor, oldest first.
+func listChanges(q dbtx, userID string, since int64, limit int) (ChangesResponse, error) {
+	resp := ChangesResponse{Cursor: since}
+	rows, err := q.Query(`
+		SELECT id, user_id, action, type, path, old_path, created_at FROM fs_changes
+		WHERE user_id = ? AND id > ?
+		ORDER BY id
+		LIMIT ?`, userID, since, limit+1)
+	if err != nil {
+		return resp, err
+	}
+	if resp.Changes, err = scanChanges(rows); err != nil {
+		return resp, err
+	}
+
+	if len(resp.Changes) > limit {
+		resp.Changes, resp.HasMore = resp.Changes[:limit], true
+	}
+	if len(resp.Changes) > 0 {
+		resp.Cursor = resp.Changes[len(resp.Changes)-1].Cursor
+	} else if err := q.QueryRow("SELECT COALESCE(MAX(id), 0) FROM fs_changes").Scan(&resp.Cursor); err != nil {
+		// Without new changes, the cursor moves to the latest change of all users
+		return resp, err
+	}
+	resp.Cursor = max(resp.Cursor, since)
+	return resp, nil
+}
+
+// ListChangesHandler returns the changes to the files of a user after the "since" cursor
+func ListChangesHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+
+		var since int64
+		if value := c.QueryParam("since"); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return c.String(http.StatusBadRequest, "Invalid cursor")
+			}
+			since = n
+		}
+		limit := defaultChangesLimit
+		if value := c.QueryParam("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return c.String(http.StatusBadRequest, "Invalid limit")
+			}
+			limit = min(n, maxChangesLimit)
+		}
+
+		resp, err := listChanges(db, userID, since, limit)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// StartFileChangeNotifier sends the new changes to the files of each user on the "api.fs.<user_id>" WebSocket channel
+func StartFileChangeNotifier(db *sql.DB, wsHandler *WebSocketHandler) {
+	var cursor int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM fs_changes").Scan(&cursor); err != nil {
+		log.Error().Err(err).Msg("Error querying file changes")
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	for range ticker.C {
+		rows, err := db.Query("SELECT id, user_id, action, type, path, old_path, created_at FROM fs_changes WHERE id > ? ORDER BY id", cursor)
+		if err != nil {
+			log.Error().Err(err).Msg("Error querying file changes")
+			continue
+		}
+		changes, err := scanChanges(rows)
+		if err != nil {
+			log.Error().Err(err).Msg("Error scanning file changes")
+			continue
+		}
+
+		for _, change := range changes {
+			content, err := json.Marshal(change)
+			if err != nil {
+				log.Error().Err(err).Msg("Error encoding file change")
+				continue
+			}
+			wsHandler.BroadcastMessage("api.fs."+change.userID, string(content))
+			cursor = change.Cursor
+		}
+	}
+}
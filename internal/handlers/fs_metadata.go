@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Files have a MIME type, detected from their name or content on every upload unless set by the client,
+// the time their content was last modified, and key/value attributes set by their owner.
+
+const (
+	maxFileAttributes     = 64
+	maxAttributeKeySize   = 128
+	maxAttributeValueSize = 4096
+)
+
+var errInvalidMetadata = errors.New("invalid metadata")
+
+// MetadataRequest updates the metadata of a file. Fields left out are unchanged, and attributes set to null are removed.
+type MetadataRequest struct {
+	UserID     string             `json:"user_id"`
+	MimeType   *string            `json:"mime_type"`
+	ModifiedAt *time.Time         `json:"modified_at"`
+	Attributes map[string]*string `json:"attributes"`
+}
+
+func (req MetadataRequest) validate() error {
+	if req.MimeType != nil {
+		if _, _, err := mime.ParseMediaType(*req.MimeType); err != nil {
+			return errInvalidMetadata
+		}
+	}
+	for key, value := range req.Attributes {
+		if key == "" || len(key) > maxAttributeKeySize || (value != nil && len(*value) > maxAttributeValueSize) {
+			return errInvalidMetadata
+		}
+	}
+	return nil
+}
+
+// parseMetadataForm reads the metadata sent along with an uploaded file: the mime_type and
+// modified_at (RFC 3339) fields, and the attributes field holding a JSON object.
+func parseMetadataForm(c echo.Context) (MetadataRequest, error) {
+	var req MetadataRequest
+	if value := c.FormValue("mime_type"); value != "" {
+		req.MimeType = &value
+	}
+	if value := c.FormValue("modified_at"); value != "" {
+		modifiedAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return req, errInvalidMetadata
+		}
+		req.ModifiedAt = &modifiedAt
+	}
+	if value := c.FormValue("attributes"); value != "" {
+		if err := json.Unmarshal([]byte(value), &req.Attributes); err != nil {
+			return req, errInvalidMetadata
+		}
+	}
+	return req, req.validate()
+}
+
+// detectMimeType returns the MIME type of a file from its extension, or from its first bytes.
+func detectMimeType(name string, head func() []byte) string {
+	if mimeType := mime.TypeByExtension(path.Ext(name)); mimeType != "" {
+		return mimeType
+	}
+	return http.DetectContentType(head())
+}
+
+// updateMimeType sets the MIME type of a file, detected from its name and content.
+func updateMimeType(q dbtx, fileID int64) error {
+	var name string
+	if err := q.QueryRow("SELECT filename FROM files WHERE id = ?", fileID).Scan(&name); err != nil {
+		return err
+	}
+	mimeType := detectMimeType(name, func() []byte {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(fileContentReader(q, fileID), head)
+		return head[:n]
+	})
+	_, err := q.Exec("UPDATE files SET mime_type = ? WHERE id = ?", mimeType, fileID)
+	return err
+}
+
+// updateFileMetadata applies a metadata update to a file.
+func updateFileMetadata(q dbtx, fileID int64, req MetadataRequest) error {
+	if req.MimeType != nil {
+		if _, err := q.Exec("UPDATE files SET mime_type = ? WHERE id = ?", *req.MimeType, fileID); err != nil {
+			return err
+		}
+	}
+	if req.ModifiedAt != nil {
+		if _, err := q.Exec("UPDATE files SET modified_at = ? WHERE id = ?", *req.ModifiedAt, fileID); err != nil {
+			return err
+		}
+	}
+	if len(req.Attributes) == 0 {
+		return nil
+	}
+
+	for key, value := range req.Attributes {
+		var err error
+		if value == nil {
+			_, err = q.Exec("DELETE FROM file_attributes WHERE file_id = ? AND key = ?", fileID, key)
+		} else {
+			_, err = q.Exec(`
+				INSERT INTO file_attributes (file_id, key, value) VALUES (?, ?, ?)
+				ON CONFLICT (file_id, key) DO UPDATE SET value = excluded.value`, fileID, key, *value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var count int
+	if err := q.QueryRow("SELECT COUNT(*) FROM file_attributes WHERE file_id = ?", fileID).Scan(&count); err != nil {
+		return err
+	}
+	if count > maxFileAttributes {
+		return errInvalidMetadata
+	}
+	return nil
+}
+
+// loadAttributes sets the attributes of the files in the slice.
+func loadAttributes(q dbtx, files []FileInfo) error {
+	index := map[int64]int{}
+	var ids []any
+	for i, fi := range files {
+		if !fi.IsDir() {
+			index[fi.id] = i
+			ids = append(ids, fi.id)
+		}
+	}
+
+	// Files are queried in batches, to stay below the limit on the number of query parameters
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+
+		rows, err := q.Query(`SELECT file_id, key, value FROM file_attributes WHERE file_id IN (?`+strings.Repeat(", ?", len(batch)-1)+`)`, batch...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var fileID int64
+			var key, value string
+			if err := rows.Scan(&fileID, &key, &value); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			fi := &files[index[fileID]]
+			if fi.Attributes == nil {
+				fi.Attributes = map[string]string{}
+			}
+			fi.Attributes[key] = value
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statFile returns a file or directory with all of its metadata.
+func statFile(q dbtx, userID, p string) (FileInfo, error) {
+	fi, err := statPath(q, userID, p)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+	if fi.SHA256 == "" {
+		if fi.SHA256, err = fileChecksum(q, fi.id); err != nil {
+			return fi, err
+		}
+	}
+	files := []FileInfo{fi}
+	err = loadAttributes(q, files)
+	return files[0], err
+}
+
+// StatHandler returns the metadata of a file or directory
+func StatHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		fi, err := statWithMounts(db, c.QueryParam("user_id"), normalizePath(c.Param("*")))
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, fi)
+	}
+}
+
+// UpdateMetadataHandler updates the MIME type, modification time and attributes of a file
+func UpdateMetadataHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filePath := normalizePath(c.Param("*"))
+		req := new(MetadataRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, "Bad Request")
+		}
+		if err := req.validate(); err != nil {
+			return respondFsError(c, err)
+		}
+		if err := checkWritable(filePath); err != nil {
+			return respondFsError(c, err)
+		}
+
+		var fi FileInfo
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			fileID, err := findFile(tx, req.UserID, filePath)
+			if err != nil {
+				return err
+			}
+			if err := updateFileMetadata(tx, fileID, *req); err != nil {
+				return err
+			}
+			if err := recordFileChange(tx, fileID, changeUpdate); err != nil {
+				return err
+			}
+			fi, err = statFile(tx, req.UserID, filePath)
+			return err
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, fi)
+	}
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Mounts are host directories configured by the administrator, served read-only under a virtual path
+// in the tree of every user, e.g. "/mnt/docs". Their content is read from the host on each request and
+// never stored. Host files are opened through an os.Root, which rejects paths and symbolic links
+// resolving outside of the mounted directory.
+
+var errReadOnly = errors.New("read-only file system")
+
+// fsMount is a host directory mounted at a path of the Files API.
+type fsMount struct {
+	path     string
+	hostPath string
+}
+
+// loadMounts reads the mounts from PORTAL_FS_MOUNTS, a comma separated list of path=host_directory
+// pairs, e.g. "/mnt/docs=/srv/docs". Invalid mounts are ignored.
+func loadMounts() []fsMount {
+	var mounts []fsMount
+	for _, entry := range strings.Split(os.Getenv("PORTAL_FS_MOUNTS"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		p, hostPath, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		m := fsMount{path: normalizePath(p), hostPath: hostPath}
+		if ok && m.path != "/" && path.IsAbs(p) && path.IsAbs(hostPath) {
+			mounts = append(mounts, m)
+		}
+	}
+	return mounts
+}
+
+// findMount returns the mount containing the path, and the path relative to the mounted directory.
+func findMount(p string) (fsMount, string, bool) {
+	for _, m := range loadMounts() {
+		if isInside(p, m.path) {
+			rel := strings.TrimPrefix(strings.TrimPrefix(p, m.path), "/")
+			if rel == "" {
+				rel = "."
+			}
+			return m, rel, true
+		}
+	}
+	return fsMount{}, "", false
+}
+
+// checkWritable returns errReadOnly if the path is inside a mount.
+func checkWritable(p string) error {
+	if _, _, ok := findMount(p); ok {
+		return errReadOnly
+	}
+	return nil
+}
+
+// mountError maps the errors of host file system operations. Paths escaping the mounted directory are
+// reported as not found, like missing files, so they reveal nothing about the host.
+func mountError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || strings.Contains(err.Error(), "path escapes") {
+		return errFileNotFound
+	}
+	return err
+}
+
+func (m fsMount) fileInfo(p string, info fs.FileInfo) FileInfo {
+	fi := FileInfo{
+		Name:       path.Base(p),
+		Path:       p,
+		Type:       fileTypeFile,
+		CreatedAt:  info.ModTime(),
+		ModifiedAt: info.ModTime(),
+		ReadOnly:   true,
+	}
+	if info.IsDir() {
+		fi.Type = fileTypeDirectory
+	} else {
+		fi.Size = info.Size()
+		fi.MimeType = mime.TypeByExtension(path.Ext(p))
+	}
+	return fi
+}
+
+// stat returns a file or directory of the mount. Anything other than files and directories is not found.
+func (m fsMount) stat(rel string) (FileInfo, error) {
+	root, err := os.OpenRoot(m.hostPath)
+	if err != nil {
+		return FileInfo{}, mountError(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	info, err := root.Stat(rel)
+	if err != nil {
+		return FileInfo{}, mountError(err)
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return FileInfo{}, errFileNotFound
+	}
+	return m.fileInfo(path.Join(m.path, rel), info), nil
+}
+
+// list returns the files and directories in a directory of the mount, directories first.
+// Symbolic links are followed as long as they stay inside the mounted directory.
+func (m fsMount) list(rel string) ([]FileInfo, error) {
+	root, err := os.OpenRoot(m.hostPath)
+	if err != nil {
+		return nil, mountError(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	dir, err := root.Open(rel)
+	if err != nil {
+		return nil, mountError(err)
+	}
+	entries, err := dir.ReadDir(-1)
+	_ = dir.Close()
+	if err != nil {
+		return nil, mountError(err)
+	}
+
+	children := []FileInfo{}
+	for _, entry := range entries {
+		childRel := path.Join(rel, entry.Name())
+		info, err := root.Stat(childRel)
+		if err != nil || (!info.IsDir() && !info.Mode().IsRegular()) {
+			continue
+		}
+		children = append(children, m.fileInfo(path.Join(m.path, childRel), info))
+	}
+	sortDirectoriesFirst(children)
+	return children, nil
+}
+
+// open opens a file of the mount for reading.
+func (m fsMount) open(rel string) (*os.File, error) {
+	root, err := os.OpenRoot(m.hostPath)
+	if err != nil {
+		return nil, mountError(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	f, err := root.Open(rel)
+	return f, mountError(err)
+}
+
+// importPath copies a file or directory of the mount, with everything inside it, to a path of a user.
+// Symbolic links to files inside the mount are imported as files, symbolic links to directories are skipped.
+func (m fsMount) importPath(q dbtx, userID, rel, dst string) error {
+	if dst == "/" {
+		return errInvalidPath
+	}
+	if _, err := statPath(q, userID, dst); err != errFileNotFound {
+		if err == nil {
+			return errFileExists
+		}
+		return err
+	}
+	root, err := os.OpenRoot(m.hostPath)
+	if err != nil {
+		return mountError(err)
+	}
+	defer func() {
+		_ = root.Close()
+	}()
+
+	return mountError(fs.WalkDir(root.FS(), rel, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, strings.TrimPrefix(strings.TrimPrefix(p, rel), "/"))
+		if rel == "." {
+			target = path.Join(dst, p)
+		}
+		if d.IsDir() {
+			return ensureDirectories(q, userID, target)
+		}
+		info, err := root.Stat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := root.Open(p)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		_, err = createFile(q, userID, target, f)
+		return err
+	}))
+}
+
+// sortDirectoriesFirst sorts a listing like listDirectory: directories, then files, each by path.
+func sortDirectoriesFirst(files []FileInfo) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].IsDir() != files[j].IsDir() {
+			return files[i].IsDir()
+		}
+		return files[i].Path < files[j].Path
+	})
+}
+
+// mountPoints returns the directories leading to mounts inside dir, as its children.
+func mountPoints(dir string) []FileInfo {
+	var children []FileInfo
+	seen := map[string]bool{}
+	for _, m := range loadMounts() {
+		if m.path == dir || !isInside(m.path, dir) {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(m.path, childPrefix(dir)), "/")
+		p := path.Join(dir, name)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		point := FileInfo{Name: name, Path: p, Type: fileTypeDirectory, ReadOnly: p == m.path}
+		if fi, err := m.stat("."); err == nil && point.ReadOnly {
+			point = fi
+		}
+		children = append(children, point)
+	}
+	return children
+}
+
+// listWithMounts lists a directory of a user along with the mounts inside it. Directories leading to
+// mounts are listed even if they don't exist in the tree of the user.
+func listWithMounts(q dbtx, userID, dir string) ([]FileInfo, error) {
+	if m, rel, ok := findMount(dir); ok {
+		return m.list(rel)
+	}
+
+	points := mountPoints(dir)
+	children, err := listDirectory(q, userID, dir)
+	if err == errFileNotFound && len(points) > 0 {
+		children, err = []FileInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, point := range points {
+		exists := false
+		for i, child := range children {
+			if child.Path == point.Path {
+				// A mount hides the directory or file at its path
+				if point.ReadOnly {
+					children[i] = point
+				}
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			children = append(children, point)
+		}
+	}
+	sortDirectoriesFirst(children)
+	return children, nil
+}
+
+// statWithMounts returns a file or directory of a user, or of a mount.
+func statWithMounts(q dbtx, userID, p string) (FileInfo, error) {
+	if m, rel, ok := findMount(p); ok {
+		return m.stat(rel)
+	}
+	fi, err := statFile(q, userID, p)
+	if err == errFileNotFound && len(mountPoints(p)) > 0 {
+		return FileInfo{Name: path.Base(p), Path: p, Type: fileTypeDirectory}, nil
+	}
+	return fi, err
+}
+
+// serveMountedFile writes a file of a mount, handling range and conditional requests.
+func serveMountedFile(c echo.Context, m fsMount, rel string) error {
+	fi, err := m.stat(rel)
+	if err != nil {
+		return respondFsError(c, err)
+	}
+	if fi.IsDir() {
+		return respondFsError(c, errIsDirectory)
+	}
+	f, err := m.open(rel)
+	if err != nil {
+		return respondFsError(c, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if fi.MimeType != "" {
+		c.Response().Header().Set(echo.HeaderContentType, fi.MimeType)
+	}
+	http.ServeContent(c.Response(), c.Request(), fi.Name, fi.ModifiedAt, f)
+	return nil
+}
@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/html"
+)
+
+// The text content of plain text, Markdown, JSON, CSV and HTML files is indexed in the file_search
+// FTS5 table. Only the current version of files is indexed.
+
+const (
+	maxIndexedSize     = 10 * 1024 * 1024 // Larger files are not indexed
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+var errEmptyQuery = errors.New("empty search query")
+
+const (
+	searchTypeText = "text"
+	searchTypeJSON = "json"
+	searchTypeCSV  = "csv"
+	searchTypeHTML = "html"
+)
+
+// SearchResult is a file matching a search query, with a snippet of the matching text.
+type SearchResult struct {
+	FileInfo
+	Snippet string `json:"snippet"`
+}
+
+// searchableType returns how the text of a file is extracted, or "" if the file is not indexed.
+// Files without extension are indexed if their content looks like text or HTML.
+func searchableType(name string, head func() []byte) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".txt", ".text", ".log", ".md", ".markdown":
+		return searchTypeText
+	case ".json":
+		return searchTypeJSON
+	case ".csv":
+		return searchTypeCSV
+	case ".html", ".htm":
+		return searchTypeHTML
+	case "":
+		contentType := http.DetectContentType(head())
+		if strings.HasPrefix(contentType, "text/plain") {
+			return searchTypeText
+		}
+		if strings.HasPrefix(contentType, "text/html") {
+			return searchTypeHTML
+		}
+	}
+	return ""
+}
+
+// extractText returns the text to index for the content of a file.
+func extractText(kind string, content []byte) string {
+	if !isText(content) {
+		return ""
+	}
+	switch kind {
+	case searchTypeJSON:
+		if text, err := extractJSONText(content); err == nil {
+			return text
+		}
+	case searchTypeCSV:
+		if text, err := extractCSVText(content); err == nil {
+			return text
+		}
+	case searchTypeHTML:
+		return extractHTMLText(content)
+	}
+	return string(content)
+}
+
+// extractJSONText returns the keys and values of a JSON document, one per line.
+func extractJSONText(content []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return "", err
+	}
+
+	var text strings.Builder
+	var walk func(value any)
+	walk = func(value any) {
+		switch v := value.(type) {
+		case map[string]any:
+			for key, item := range v {
+				text.WriteString(key + "\n")
+				walk(item)
+			}
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		case string:
+			text.WriteString(v + "\n")
+		case json.Number:
+			text.WriteString(v.String() + "\n")
+		}
+	}
+	walk(document)
+	return text.String(), nil
+}
+
+// extractCSVText returns the fields of a CSV document, one record per line.
+func extractCSVText(content []byte) (string, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var text strings.Builder
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return text.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		text.WriteString(strings.Join(record, " ") + "\n")
+	}
+}
+
+// extractHTMLText returns the text of an HTML document, without markup, scripts and styles.
+func extractHTMLText(content []byte) string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(content))
+	var text strings.Builder
+	skip := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return text.String()
+		case html.StartTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				if t := strings.TrimSpace(string(tokenizer.Text())); t != "" {
+					text.WriteString(t + "\n")
+				}
+			}
+		}
+	}
+}
+
+// indexFile updates the search index for the current content of a file.
+func indexFile(q dbtx, fileID int64) error {
+	if _, err := q.Exec("DELETE FROM file_search WHERE rowid = ?", fileID); err != nil {
+		return err
+	}
+
+	var p string
+	var size int64
+	if err := q.QueryRow("SELECT path, size FROM files WHERE id = ?", fileID).Scan(&p, &size); err != nil {
+		return err
+	}
+
+	// Files without text get an empty row, so they aren't read again by indexMissingFiles
+	var text string
+	if size <= maxIndexedSize {
+		kind := searchableType(path.Base(p), func() []byte {
+			head := make([]byte, 512)
+			n, _ := io.ReadFull(fileContentReader(q, fileID), head)
+			return head[:n]
+		})
+		if kind != "" {
+			content, err := io.ReadAll(fileContentReader(q, fileID))
+			if err != nil {
+				return err
+			}
+			text = extractText(kind, content)
+		}
+	}
+	_, err := q.Exec("INSERT INTO file_search (rowid, content) VALUES (?, ?)", fileID, text)
+	return err
+}
+
+// indexMissingFiles indexes the files missing from the search index, e.g. files stored before it existed.
+func indexMissingFiles(db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT id FROM files
+		WHERE id NOT IN (SELECT rowid FROM file_search)
+			AND id NOT IN (SELECT content_id FROM file_versions)
+			AND id NOT IN (SELECT file_id FROM file_uploads)`)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query files to index")
+		return
+	}
+	var fileIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Error().Err(err).Msg("Failed to scan file to index")
+			break
+		}
+		fileIDs = append(fileIDs, id)
+	}
+	if err := rows.Close(); err != nil {
+		log.Error().Err(err).Msg("Error closing rows")
+	}
+
+	for _, id := range fileIDs {
+		if err := inTransaction(db, func(tx *sql.Tx) error { return indexFile(tx, id) }); err != nil {
+			log.Error().Err(err).Msgf("Failed to index file %d", id)
+		}
+	}
+}
+
+// ftsQuery turns a user query into an FTS5 query matching all of its terms.
+// Terms ending with "*" match as prefix.
+func ftsQuery(query string) string {
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		prefix := strings.HasSuffix(term, "*")
+		term = strings.TrimRight(term, "*")
+		if term == "" {
+			continue
+		}
+		term = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// searchFiles returns the files of a user inside the directory matching the query, best matches first.
+func searchFiles(q dbtx, userID, query, dir string, limit int) ([]SearchResult, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, errEmptyQuery
+	}
+
+	from, to := prefixRange(childPrefix(dir))
+	rows, err := q.Query(`
+		SELECT `+fileColumns+`, snippet(file_search, 0, '<mark>', '</mark>', '…', 16)
+		FROM file_search JOIN files ON files.id = file_search.rowid
+		WHERE file_search MATCH ? AND files.user_id = ? AND files.path >= ? AND files.path < ?
+		ORDER BY rank
+		LIMIT ?`, match, userID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		fi, err := scanFile(rows, &r.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		r.FileInfo = fi
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// SearchFilesHandler handles full-text search in the files of a user
+func SearchFilesHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		dirPath := normalizePath(c.QueryParam("path"))
+
+		limit := defaultSearchLimit
+		if value := c.QueryParam("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return c.String(http.StatusBadRequest, "Invalid limit")
+			}
+			limit = min(n, maxSearchLimit)
+		}
+
+		results, err := searchFiles(db, userID, c.QueryParam("q"), dirPath, limit)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, results)
+	}
+}
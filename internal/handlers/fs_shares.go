@@ -0,0 +1,543 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Share links give access to a file or directory without a user ID, on the public /s/{token} route.
+
+const (
+	shareModeRead   = "read"   // Download the file, or list and download the files of the directory
+	shareModeUpload = "upload" // Upload files into the directory, without seeing its content
+
+	sharePasswordIterations = 600000
+	sharePasswordHeader     = "X-Share-Password"
+
+	// After a correct password, a cookie gives access to the link without checking the password again
+	shareCookieName     = "portal_share"
+	shareCookieDuration = time.Hour
+
+	// Passwords are not checked after too many failed attempts on a link, until the window ends
+	shareMaxFailures   = 10
+	shareFailureWindow = 10 * time.Minute
+)
+
+var (
+	errShareExpired       = errors.New("share link expired")
+	errSharePassword      = errors.New("invalid share password")
+	errShareMode          = errors.New("not allowed by the share link")
+	errShareDownloadLimit = errors.New("download limit reached")
+	errShareAttempts      = errors.New("too many password attempts")
+	errInvalidShare       = errors.New("invalid share link")
+)
+
+type ShareRequest struct {
+	UserID       string `json:"user_id" form:"user_id"`
+	Path         string `json:"path" form:"path"`
+	Mode         string `json:"mode" form:"mode"`
+	Password     string `json:"password" form:"password"`
+	ExpiresAt    string `json:"expires_at" form:"expires_at"` // RFC 3339
+	ExpiresIn    int    `json:"expires_in" form:"expires_in"` // Seconds
+	MaxDownloads int    `json:"max_downloads" form:"max_downloads"`
+}
+
+// FileShare is a share link for a file or directory.
+type FileShare struct {
+	Token             string     `json:"token"`
+	URL               string     `json:"url"`
+	Path              string     `json:"path"`
+	Mode              string     `json:"mode"`
+	PasswordProtected bool       `json:"password_protected"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads      *int       `json:"max_downloads,omitempty"`
+	Downloads         int        `json:"downloads"`
+	CreatedAt         time.Time  `json:"created_at"`
+
+	id           int64
+	userID       string
+	passwordHash string
+}
+
+// hashSharePassword derives a PBKDF2-SHA256 hash of the password, encoded with its parameters.
+func hashSharePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", sharePasswordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkSharePassword reports whether the password matches the hash.
+func checkSharePassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// shareCookieKey signs the share cookies. It's generated at startup, cookies are invalid after a restart.
+var shareCookieKey = func() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+// shareCookieMAC signs a cookie of the share link valid until expires. The password hash is signed
+// with the token, so cookies are invalid for another link.
+func shareCookieMAC(share FileShare, expires int64) []byte {
+	mac := hmac.New(sha256.New, shareCookieKey)
+	fmt.Fprintf(mac, "%s\n%s\n%d", share.Token, share.passwordHash, expires)
+	return mac.Sum(nil)
+}
+
+// setShareCookie sets the cookie giving access to a password protected share link.
+func setShareCookie(c echo.Context, share FileShare) {
+	expires := time.Now().Add(shareCookieDuration)
+	c.SetCookie(&http.Cookie{
+		Name:     shareCookieName,
+		Value:    strconv.FormatInt(expires.Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(shareCookieMAC(share, expires.Unix())),
+		Path:     "/s/" + share.Token,
+		Expires:  expires,
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// hasShareCookie reports whether the request has a valid cookie of the share link.
+func hasShareCookie(c echo.Context, share FileShare) bool {
+	cookie, err := c.Cookie(shareCookieName)
+	if err != nil {
+		return false
+	}
+	expiresValue, macValue, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresValue, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(macValue)
+	return err == nil && hmac.Equal(mac, shareCookieMAC(share, expires))
+}
+
+// shareFailures counts the failed password attempts on each share link, by token.
+type shareFailures struct {
+	mutex    sync.Mutex
+	failures map[string]shareFailure
+}
+
+type shareFailure struct {
+	count int
+	since time.Time
+}
+
+var sharePasswordFailures = &shareFailures{failures: map[string]shareFailure{}}
+
+// blocked reports whether the link had too many failed attempts in the current window.
+func (f *shareFailures) blocked(token string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	failure, ok := f.failures[token]
+	if ok && time.Since(failure.since) > shareFailureWindow {
+		delete(f.failures, token)
+		return false
+	}
+	return failure.count >= shareMaxFailures
+}
+
+func (f *shareFailures) add(token string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	failure, ok := f.failures[token]
+	if !ok || time.Since(failure.since) > shareFailureWindow {
+		failure = shareFailure{since: time.Now()}
+	}
+	failure.count++
+	f.failures[token] = failure
+}
+
+func newShareToken() (string, error) {
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+const shareColumns = "id, token, user_id, path, mode, password_hash, expires_at, max_downloads, downloads, created_at"
+
+func scanShare(row interface{ Scan(...any) error }) (FileShare, error) {
+	var share FileShare
+	var passwordHash sql.NullString
+	var expiresAt sql.NullTime
+	var maxDownloads sql.NullInt64
+	err := row.Scan(&share.id, &share.Token, &share.userID, &share.Path, &share.Mode, &passwordHash,
+		&expiresAt, &maxDownloads, &share.Downloads, &share.CreatedAt)
+	if err != nil {
+		return share, err
+	}
+	share.URL = "/s/" + share.Token
+	share.passwordHash = passwordHash.String
+	share.PasswordProtected = passwordHash.Valid
+	if expiresAt.Valid {
+		share.ExpiresAt = &expiresAt.Time
+	}
+	if maxDownloads.Valid {
+		n := int(maxDownloads.Int64)
+		share.MaxDownloads = &n
+	}
+	return share, nil
+}
+
+func loadShare(q dbtx, token string) (FileShare, error) {
+	share, err := scanShare(q.QueryRow("SELECT "+shareColumns+" FROM file_shares WHERE token = ?", token))
+	if err == sql.ErrNoRows {
+		return share, errFileNotFound
+	}
+	return share, err
+}
+
+func listShares(q dbtx, userID string) ([]FileShare, error) {
+	rows, err := q.Query("SELECT "+shareColumns+" FROM file_shares WHERE user_id = ? ORDER BY created_at DESC, id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	shares := []FileShare{}
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+// createShare creates a share link for the file or directory described by the request.
+func createShare(q dbtx, req ShareRequest) (FileShare, error) {
+	share := FileShare{Path: normalizePath(req.Path), Mode: req.Mode, userID: req.UserID, CreatedAt: time.Now()}
+	if share.Mode == "" {
+		share.Mode = shareModeRead
+	}
+	if share.Mode != shareModeRead && share.Mode != shareModeUpload {
+		return share, fmt.Errorf("%w: invalid mode", errInvalidShare)
+	}
+	if share.Path == "/" {
+		return share, errInvalidPath
+	}
+
+	fi, err := statPath(q, req.UserID, share.Path)
+	if err != nil {
+		return share, err
+	}
+	if share.Mode == shareModeUpload && !fi.IsDir() {
+		return share, errNotDirectory
+	}
+
+	switch {
+	case req.ExpiresAt != "":
+		expiresAt, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			return share, fmt.Errorf("%w: invalid expires_at", errInvalidShare)
+		}
+		share.ExpiresAt = &expiresAt
+	case req.ExpiresIn > 0:
+		expiresAt := share.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		share.ExpiresAt = &expiresAt
+	}
+	if req.MaxDownloads > 0 {
+		share.MaxDownloads = &req.MaxDownloads
+	}
+
+	var passwordHash sql.NullString
+	if req.Password != "" {
+		if passwordHash.String, err = hashSharePassword(req.Password); err != nil {
+			return share, err
+		}
+		passwordHash.Valid = true
+		share.PasswordProtected = true
+	}
+
+	if share.Token, err = newShareToken(); err != nil {
+		return share, err
+	}
+	share.URL = "/s/" + share.Token
+
+	res, err := q.Exec(`
+		INSERT INTO file_shares (token, user_id, path, mode, password_hash, expires_at, max_downloads, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		share.Token, share.userID, share.Path, share.Mode, passwordHash, share.ExpiresAt, share.MaxDownloads, share.CreatedAt)
+	if err != nil {
+		return share, err
+	}
+	share.id, err = res.LastInsertId()
+	return share, err
+}
+
+// checkShareAccess verifies that the share link can be used by the request.
+func checkShareAccess(c echo.Context, share FileShare, mode string) error {
+	if share.ExpiresAt != nil && time.Now().After(*share.ExpiresAt) {
+		return errShareExpired
+	}
+	if share.passwordHash != "" && !hasShareCookie(c, share) {
+		// The password is never read from the query string, which ends up in access logs
+		r := c.Request()
+		password := r.Header.Get(sharePasswordHeader)
+		if password == "" && r.Method == http.MethodPost {
+			password = r.PostFormValue("password")
+		}
+		if _, basicPassword, ok := r.BasicAuth(); ok && password == "" {
+			password = basicPassword
+		}
+		if password == "" {
+			return errSharePassword
+		}
+		if sharePasswordFailures.blocked(share.Token) {
+			return errShareAttempts
+		}
+		if !checkSharePassword(share.passwordHash, password) {
+			sharePasswordFailures.add(share.Token)
+			return errSharePassword
+		}
+		setShareCookie(c, share)
+	}
+	if share.Mode != mode {
+		return errShareMode
+	}
+	return nil
+}
+
+// countShareDownload counts a download of a shared file, failing if the download limit is reached.
+// Range requests count too, otherwise the limit could be bypassed by downloading the file in ranges.
+func countShareDownload(q dbtx, c echo.Context, share FileShare) error {
+	if c.Request().Method != http.MethodGet {
+		return nil
+	}
+
+	res, err := q.Exec(`
+		UPDATE file_shares SET downloads = downloads + 1
+		WHERE id = ? AND (max_downloads IS NULL OR downloads < max_downloads)`, share.id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errShareDownloadLimit
+	}
+	return nil
+}
+
+// respondShareError writes the response for an error of the share links
+func respondShareError(c echo.Context, err error) error {
+	switch {
+	case err == errShareExpired:
+		return c.String(http.StatusGone, "Share link expired")
+	case err == errShareDownloadLimit:
+		return c.String(http.StatusGone, "Download limit reached")
+	case err == errShareAttempts:
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(shareFailureWindow.Seconds())))
+		return c.String(http.StatusTooManyRequests, "Too many password attempts")
+	case err == errSharePassword:
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="share"`)
+		return c.String(http.StatusUnauthorized, "Password required")
+	case err == errShareMode:
+		return c.String(http.StatusForbidden, "Not allowed by this share link")
+	case errors.Is(err, errInvalidShare):
+		return c.String(http.StatusBadRequest, strings.TrimPrefix(err.Error(), errInvalidShare.Error()+": "))
+	}
+	return respondFsError(c, err)
+}
+
+// CreateShareHandler creates a share link for a file or directory
+func CreateShareHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(ShareRequest)
+		if err := c.Bind(req); err != nil || req.Path == "" {
+			return c.String(http.StatusBadRequest, "Bad Request")
+		}
+
+		share, err := createShare(db, *req)
+		if err != nil {
+			return respondShareError(c, err)
+		}
+
+		return c.JSON(http.StatusCreated, share)
+	}
+}
+
+// ListSharesHandler lists the share links of a user
+func ListSharesHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		shares, err := listShares(db, c.QueryParam("user_id"))
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, shares)
+	}
+}
+
+// DeleteShareHandler revokes a share link
+func DeleteShareHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		res, err := db.Exec("DELETE FROM file_shares WHERE token = ? AND user_id = ?", c.Param("token"), c.QueryParam("user_id"))
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return c.String(http.StatusNotFound, "Share link not found")
+		}
+
+		return c.String(http.StatusOK, "Share link deleted successfully")
+	}
+}
+
+// SharedReadHandler serves a shared file, or lists and serves the files of a shared directory.
+// Paths in directory listings are relative to the shared directory.
+func SharedReadHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		share, err := loadShare(db, c.Param("token"))
+		if err != nil {
+			return respondShareError(c, err)
+		}
+		if err := checkShareAccess(c, share, shareModeRead); err != nil {
+			return respondShareError(c, err)
+		}
+
+		target := share.Path
+		if sub := normalizePath(c.Param("*")); sub != "/" {
+			target = share.Path + sub
+		}
+		fi, err := statPath(db, share.userID, target)
+		if err != nil {
+			return respondShareError(c, err)
+		}
+
+		if fi.IsDir() {
+			children, err := listDirectory(db, share.userID, target)
+			if err != nil {
+				return respondShareError(c, err)
+			}
+			// Attributes are private to the owner of the files
+			shared := []FileInfo{}
+			for _, child := range children {
+				if !isInside(child.Path, share.Path) {
+					continue
+				}
+				child.Path = strings.TrimPrefix(child.Path, share.Path)
+				child.Attributes = nil
+				shared = append(shared, child)
+			}
+			return c.JSON(http.StatusOK, shared)
+		}
+
+		if err := countShareDownload(db, c, share); err != nil {
+			return respondShareError(c, err)
+		}
+		log.Info().Msgf("Serving shared file %s of user %s", target, share.userID)
+		return serveFileContent(c, db, fi.Name, fi.id, fi.ModifiedAt)
+	}
+}
+
+// SharedUploadHandler uploads a file into a directory shared for uploads
+func SharedUploadHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		share, err := loadShare(db, c.Param("token"))
+		if err != nil {
+			return respondShareError(c, err)
+		}
+		if err := checkShareAccess(c, share, shareModeUpload); err != nil {
+			return respondShareError(c, err)
+		}
+
+		file, err := c.FormFile("file")
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Bad Request")
+		}
+		name := path.Base(normalizePath(file.Filename))
+		if name == "/" {
+			return respondShareError(c, errInvalidPath)
+		}
+
+		src, err := file.Open()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to open file")
+			return c.String(http.StatusInternalServerError, "Internal Server Error")
+		}
+		defer func() {
+			if cerr := src.Close(); cerr != nil {
+				log.Error().Err(cerr).Msg("Error closing file")
+			}
+		}()
+
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			fi, err := statPath(tx, share.userID, share.Path)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return errNotDirectory
+			}
+			_, err = createFile(tx, share.userID, path.Join(share.Path, name), src)
+			return err
+		})
+		if err != nil {
+			return respondShareError(c, err)
+		}
+
+		return c.String(http.StatusCreated, "File uploaded successfully")
+	}
+}
+
+// SetupFileShareHandlers sets up the public routes of the share links
+func SetupFileShareHandlers(shareGroup *echo.Group, db *sql.DB) {
+	shareGroup.GET("/:token", SharedReadHandler(db))
+	shareGroup.HEAD("/:token", SharedReadHandler(db))
+	shareGroup.GET("/:token/*", SharedReadHandler(db))
+	shareGroup.HEAD("/:token/*", SharedReadHandler(db))
+	shareGroup.POST("/:token", SharedUploadHandler(db))
+}
@@ -0,0 +1,765 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Paths in the files and directories tables are absolute and clean, e.g. "/user/files/README.md".
+// The root directory "/" is implicit and never stored.
+//
+// Files and directories whose path does not start with "/" are internal, e.g. ".uploads/<id>" for the
+// staging file of a resumable upload, or ".trash/<id>/user/files" for a deleted directory. Request paths
+// always go through normalizePath, so internal paths can't be addressed by clients and never match a
+// directory prefix.
+
+const fileChunkSize = 1024 * 1024 // 1MB chunks
+
+const (
+	fileTypeFile      = "file"
+	fileTypeDirectory = "directory"
+)
+
+var (
+	errFileNotFound      = errors.New("file not found")
+	errFileExists        = errors.New("file already exists")
+	errNotDirectory      = errors.New("not a directory")
+	errIsDirectory       = errors.New("is a directory")
+	errDirectoryNotEmpty = errors.New("directory not empty")
+	errInvalidPath       = errors.New("invalid path")
+)
+
+// FileInfo describes a file or directory in the Files API.
+type FileInfo struct {
+	Name       string            `json:"name"`
+	Path       string            `json:"path"`
+	Type       string            `json:"type"` // "file" | "directory"
+	Size       int64             `json:"size"`
+	MimeType   string            `json:"mime_type,omitempty"`
+	SHA256     string            `json:"sha256,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ModifiedAt time.Time         `json:"modified_at"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	ReadOnly   bool              `json:"read_only,omitempty"` // Files and directories of mounts
+
+	id int64
+}
+
+func (fi FileInfo) IsDir() bool {
+	return fi.Type == fileTypeDirectory
+}
+
+// fileColumns are the columns of the files table read by scanFile.
+const fileColumns = "id, path, size, mime_type, sha256, created_at, modified_at"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanFile reads the fileColumns of a file, followed by the extra columns.
+func scanFile(row rowScanner, extra ...any) (FileInfo, error) {
+	fi := FileInfo{Type: fileTypeFile}
+	var mimeType, sum sql.NullString
+	dest := append([]any{&fi.id, &fi.Path, &fi.Size, &mimeType, &sum, &fi.CreatedAt, &fi.ModifiedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return fi, err
+	}
+	fi.Name = path.Base(fi.Path)
+	fi.MimeType, fi.SHA256 = mimeType.String, sum.String
+	return fi, nil
+}
+
+// dbtx is implemented by both *sql.DB and *sql.Tx.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// normalizePath turns a path from a request into a clean absolute path.
+func normalizePath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// childPrefix returns the prefix shared by all paths inside the directory.
+func childPrefix(dir string) string {
+	if dir == "/" {
+		return "/"
+	}
+	return dir + "/"
+}
+
+// prefixRange returns the bounds of the paths starting with prefix, which ends with a slash, to be
+// used as `path >= ? AND path < ?`. Unlike LIKE, which ignores ASCII case, the range compares paths
+// as bytes, so /Docs isn't inside /docs, and it uses the path indexes.
+func prefixRange(prefix string) (string, string) {
+	return prefix, strings.TrimSuffix(prefix, "/") + "0" // '0' follows '/'
+}
+
+// isInside reports whether p is the directory dir or is located in it.
+func isInside(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, childPrefix(dir))
+}
+
+// statPath returns the file or directory at the path.
+func statPath(q dbtx, userID, p string) (FileInfo, error) {
+	if p == "/" {
+		return FileInfo{Name: "/", Path: "/", Type: fileTypeDirectory}, nil
+	}
+
+	fi, err := scanFile(q.QueryRow("SELECT "+fileColumns+" FROM files WHERE user_id = ? AND path = ?", userID, p))
+	if err == nil {
+		return fi, nil
+	}
+	if err != sql.ErrNoRows {
+		return fi, err
+	}
+
+	fi = FileInfo{Path: p, Name: path.Base(p), Type: fileTypeDirectory}
+	err = q.QueryRow("SELECT id, created_at FROM directories WHERE user_id = ? AND path = ?", userID, p).
+		Scan(&fi.id, &fi.CreatedAt)
+	if err == sql.ErrNoRows {
+		return fi, errFileNotFound
+	}
+	fi.ModifiedAt = fi.CreatedAt
+	return fi, err
+}
+
+// findFile returns the ID of the regular file at the path.
+func findFile(q dbtx, userID, p string) (int64, error) {
+	fi, err := statPath(q, userID, p)
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir() {
+		return 0, errIsDirectory
+	}
+	return fi.id, nil
+}
+
+// ensureDirectories creates the directory and all of its missing parents, like `mkdir -p`.
+// It fails if a file exists in place of any of them.
+func ensureDirectories(q dbtx, userID, dir string) error {
+	if err := checkWritable(dir); err != nil {
+		return err
+	}
+	var created []string
+	for p := dir; p != "/"; p = path.Dir(p) {
+		var exists bool
+		err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM files WHERE user_id = ? AND path = ?)", userID, p).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errNotDirectory
+		}
+		res, err := q.Exec("INSERT OR IGNORE INTO directories (user_id, path) VALUES (?, ?)", userID, p)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n > 0 {
+			created = append(created, p)
+		}
+	}
+
+	// Parents are recorded before their children
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := recordChange(q, userID, changeCreate, fileTypeDirectory, created[i], ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileContent stores the content of r as chunks of the file and returns its size and checksum.
+// Chunks are always full, except the last one.
+func writeFileContent(q dbtx, fileID int64, r io.Reader) (int64, string, error) {
+	buffer := make([]byte, fileChunkSize)
+	hash := sha256.New()
+	var size int64
+	for chunkIndex := 0; ; chunkIndex++ {
+		n, err := io.ReadFull(r, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return size, "", err
+		}
+		if n == 0 {
+			return size, hex.EncodeToString(hash.Sum(nil)), nil
+		}
+
+		if _, err := q.Exec("INSERT INTO file_content (file_id, chunk_index, content) VALUES (?, ?, ?)", fileID, chunkIndex, buffer[:n]); err != nil {
+			return size, "", err
+		}
+		hash.Write(buffer[:n])
+		size += int64(n)
+	}
+}
+
+// createFile creates a new file with the content of r, along with its parent directories.
+func createFile(q dbtx, userID, p string, r io.Reader) (int64, error) {
+	if p == "/" {
+		return 0, errInvalidPath
+	}
+	if err := checkWritable(p); err != nil {
+		return 0, err
+	}
+	if _, err := statPath(q, userID, p); err != errFileNotFound {
+		if err == nil {
+			return 0, errFileExists
+		}
+		return 0, err
+	}
+	if err := ensureDirectories(q, userID, path.Dir(p)); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	res, err := q.Exec("INSERT INTO files (user_id, path, filename, size, created_at, modified_at) VALUES (?, ?, ?, 0, ?, ?)",
+		userID, p, path.Base(p), now, now)
+	if err != nil {
+		return 0, err
+	}
+	fileID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	size, sum, err := writeFileContent(q, fileID, r)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := q.Exec("UPDATE files SET size = ?, sha256 = ? WHERE id = ?", size, sum, fileID); err != nil {
+		return 0, err
+	}
+	if err := updateMimeType(q, fileID); err != nil {
+		return 0, err
+	}
+	if err := recordChange(q, userID, changeCreate, fileTypeFile, p, ""); err != nil {
+		return 0, err
+	}
+	return fileID, indexFile(q, fileID)
+}
+
+// replaceFileContent replaces the content of an existing file, keeping the previous content as a version.
+func replaceFileContent(q dbtx, fileID int64, r io.Reader) error {
+	if err := archiveFileContent(q, fileID); err != nil {
+		return err
+	}
+	size, sum, err := writeFileContent(q, fileID, r)
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec("UPDATE files SET size = ?, sha256 = ?, modified_at = ? WHERE id = ?", size, sum, time.Now(), fileID); err != nil {
+		return err
+	}
+	if err := updateMimeType(q, fileID); err != nil {
+		return err
+	}
+	if err := recordFileChange(q, fileID, changeUpdate); err != nil {
+		return err
+	}
+	return indexFile(q, fileID)
+}
+
+// deleteFileByID removes a file, its content, its previous versions, its attributes and its previews.
+func deleteFileByID(q dbtx, fileID int64) error {
+	if err := recordFileChange(q, fileID, changeDelete); err != nil {
+		return err
+	}
+	if err := deleteFileVersions(q, "f.id = ?", fileID); err != nil {
+		return err
+	}
+	if _, err := q.Exec("DELETE FROM file_search WHERE rowid = ?", fileID); err != nil {
+		return err
+	}
+	if _, err := q.Exec("DELETE FROM file_attributes WHERE file_id = ?", fileID); err != nil {
+		return err
+	}
+	if _, err := q.Exec("DELETE FROM previews WHERE source = ? AND source_id = ?", previewSourceFile, fileID); err != nil {
+		return err
+	}
+	if _, err := q.Exec("DELETE FROM file_content WHERE file_id = ?", fileID); err != nil {
+		return err
+	}
+	_, err := q.Exec("DELETE FROM files WHERE id = ?", fileID)
+	return err
+}
+
+// fileContentReader returns a reader over the chunks of a file, loading one chunk at a time.
+func fileContentReader(q dbtx, fileID int64) io.Reader {
+	return &chunkReader{q: q, fileID: fileID}
+}
+
+type chunkReader struct {
+	q      dbtx
+	fileID int64
+	next   int
+	chunk  []byte
+	done   bool
+}
+
+// fileChecksum returns the hex encoded SHA-256 of the file content. Checksums missing for files
+// stored before they were introduced, or assembled from a resumable upload, are computed and saved.
+func fileChecksum(q dbtx, fileID int64) (string, error) {
+	var sum sql.NullString
+	if err := q.QueryRow("SELECT sha256 FROM files WHERE id = ?", fileID).Scan(&sum); err != nil {
+		if err == sql.ErrNoRows {
+			return "", errFileNotFound
+		}
+		return "", err
+	}
+	if sum.Valid {
+		return sum.String, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fileContentReader(q, fileID)); err != nil {
+		return "", err
+	}
+	sum.String = hex.EncodeToString(hash.Sum(nil))
+	_, err := q.Exec("UPDATE files SET sha256 = ? WHERE id = ?", sum.String, fileID)
+	return sum.String, err
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.q.QueryRow("SELECT chunk_index, content FROM file_content WHERE file_id = ? AND chunk_index >= ? ORDER BY chunk_index LIMIT 1",
+			r.fileID, r.next).Scan(&r.next, &r.chunk)
+		if err == sql.ErrNoRows {
+			r.done = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.next++
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// openFileContent returns a seekable reader over the chunks of a file. Only the chunks covering the
+// requested bytes are loaded, so reading a range of a large file doesn't load all of it.
+func openFileContent(q dbtx, fileID int64) (*chunkReadSeeker, error) {
+	// length counts characters in TEXT values, the cast counts bytes whatever the type of the content
+	rows, err := q.Query("SELECT chunk_index, length(CAST(content AS BLOB)) FROM file_content WHERE file_id = ? ORDER BY chunk_index", fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	r := &chunkReadSeeker{q: q, fileID: fileID, current: -1}
+	for rows.Next() {
+		var index int
+		var length int64
+		if err := rows.Scan(&index, &length); err != nil {
+			return nil, err
+		}
+		r.indexes = append(r.indexes, index)
+		r.offsets = append(r.offsets, r.size)
+		r.size += length
+	}
+	return r, rows.Err()
+}
+
+type chunkReadSeeker struct {
+	q       dbtx
+	fileID  int64
+	indexes []int   // chunk_index of each chunk
+	offsets []int64 // offset of the first byte of each chunk
+	size    int64
+	pos     int64
+	current int // position of the loaded chunk in indexes
+	chunk   []byte
+}
+
+func (r *chunkReadSeeker) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	// The last chunk starting at or before the position contains it
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > r.pos }) - 1
+	if i != r.current {
+		r.chunk = nil
+		err := r.q.QueryRow("SELECT content FROM file_content WHERE file_id = ? AND chunk_index = ?", r.fileID, r.indexes[i]).Scan(&r.chunk)
+		if err != nil {
+			return 0, err
+		}
+		r.current = i
+	}
+
+	n := copy(p, r.chunk[r.pos-r.offsets[i]:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *chunkReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// listDirectory returns the immediate children of a directory, directories first.
+func listDirectory(q dbtx, userID, dir string) ([]FileInfo, error) {
+	fi, err := statPath(q, userID, dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errNotDirectory
+	}
+
+	prefix := childPrefix(dir)
+	from, to := prefixRange(prefix)
+	children := []FileInfo{}
+
+	rows, err := q.Query(`
+		SELECT id, path, created_at FROM directories
+		WHERE user_id = ? AND path >= ? AND path < ? AND instr(substr(path, length(?) + 1), '/') = 0
+		ORDER BY path`, userID, from, to, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		child := FileInfo{Type: fileTypeDirectory}
+		if err := rows.Scan(&child.id, &child.Path, &child.CreatedAt); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		child.Name = path.Base(child.Path)
+		child.ModifiedAt = child.CreatedAt
+		children = append(children, child)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`
+		SELECT `+fileColumns+` FROM files
+		WHERE user_id = ? AND path >= ? AND path < ? AND instr(substr(path, length(?) + 1), '/') = 0
+		ORDER BY path`, userID, from, to, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		child, err := scanFile(rows)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	return children, loadAttributes(q, children)
+}
+
+// walkFiles returns all files inside a directory, at any depth.
+func walkFiles(q dbtx, userID, dir string) ([]FileInfo, error) {
+	from, to := prefixRange(childPrefix(dir))
+	rows, err := q.Query(`
+		SELECT `+fileColumns+` FROM files
+		WHERE user_id = ? AND path >= ? AND path < ?
+		ORDER BY path`, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var files []FileInfo
+	for rows.Next() {
+		fi, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fi)
+	}
+	return files, rows.Err()
+}
+
+// walkDirectories returns all directories inside a directory, at any depth, parents first.
+func walkDirectories(q dbtx, userID, dir string) ([]FileInfo, error) {
+	from, to := prefixRange(childPrefix(dir))
+	rows, err := q.Query(`
+		SELECT id, path, created_at FROM directories
+		WHERE user_id = ? AND path >= ? AND path < ?
+		ORDER BY path`, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var dirs []FileInfo
+	for rows.Next() {
+		fi := FileInfo{Type: fileTypeDirectory}
+		if err := rows.Scan(&fi.id, &fi.Path, &fi.CreatedAt); err != nil {
+			return nil, err
+		}
+		fi.Name = path.Base(fi.Path)
+		fi.ModifiedAt = fi.CreatedAt
+		dirs = append(dirs, fi)
+	}
+	return dirs, rows.Err()
+}
+
+// makeDirectory creates a directory. With parents, missing parents are created and an
+// existing directory is not an error, like `mkdir -p`.
+func makeDirectory(q dbtx, userID, dir string, parents bool) error {
+	if dir == "/" {
+		return errFileExists
+	}
+	if err := checkWritable(dir); err != nil {
+		return err
+	}
+	fi, err := statPath(q, userID, dir)
+	if err == nil {
+		if parents && fi.IsDir() {
+			return nil
+		}
+		return errFileExists
+	}
+	if err != errFileNotFound {
+		return err
+	}
+
+	if !parents {
+		parent, err := statPath(q, userID, path.Dir(dir))
+		if err != nil {
+			return err
+		}
+		if !parent.IsDir() {
+			return errNotDirectory
+		}
+	}
+	return ensureDirectories(q, userID, dir)
+}
+
+// removePath deletes a file, or a directory. Non-empty directories are only deleted when recursive.
+func removePath(q dbtx, userID, p string, recursive bool) error {
+	if p == "/" {
+		return errInvalidPath
+	}
+	if err := checkWritable(p); err != nil {
+		return err
+	}
+	fi, err := statPath(q, userID, p)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return deleteFileByID(q, fi.id)
+	}
+
+	if !recursive {
+		if err := checkDirectoryEmpty(q, userID, p); err != nil {
+			return err
+		}
+	}
+	if err := deletePrefix(q, userID, childPrefix(p)); err != nil {
+		return err
+	}
+	if _, err := q.Exec("DELETE FROM directories WHERE user_id = ? AND path = ?", userID, p); err != nil {
+		return err
+	}
+	return recordChange(q, userID, changeDelete, fileTypeDirectory, p, "")
+}
+
+// checkDirectoryEmpty returns errDirectoryNotEmpty if the directory has any children.
+func checkDirectoryEmpty(q dbtx, userID, dir string) error {
+	from, to := prefixRange(childPrefix(dir))
+	var hasChildren bool
+	err := q.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM files WHERE user_id = ? AND path >= ? AND path < ?)
+			OR EXISTS (SELECT 1 FROM directories WHERE user_id = ? AND path >= ? AND path < ?)`,
+		userID, from, to, userID, from, to).Scan(&hasChildren)
+	if err != nil {
+		return err
+	}
+	if hasChildren {
+		return errDirectoryNotEmpty
+	}
+	return nil
+}
+
+// deletePrefix deletes the files and directories whose path starts with the prefix (see prefixRange),
+// along with the content, versions, attributes and previews of the files.
+func deletePrefix(q dbtx, userID, prefix string) error {
+	from, to := prefixRange(prefix)
+	if err := deleteFileVersions(q, `f.user_id = ? AND f.path >= ? AND f.path < ?`, userID, from, to); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`
+		DELETE FROM file_search WHERE rowid IN (
+			SELECT id FROM files WHERE user_id = ? AND path >= ? AND path < ?
+		)`, userID, from, to); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`
+		DELETE FROM file_attributes WHERE file_id IN (
+			SELECT id FROM files WHERE user_id = ? AND path >= ? AND path < ?
+		)`, userID, from, to); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`
+		DELETE FROM previews WHERE source = ? AND source_id IN (
+			SELECT id FROM files WHERE user_id = ? AND path >= ? AND path < ?
+		)`, previewSourceFile, userID, from, to); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`
+		DELETE FROM file_content WHERE file_id IN (
+			SELECT id FROM files WHERE user_id = ? AND path >= ? AND path < ?
+		)`, userID, from, to); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`DELETE FROM files WHERE user_id = ? AND path >= ? AND path < ?`, userID, from, to); err != nil {
+		return err
+	}
+	_, err := q.Exec(`DELETE FROM directories WHERE user_id = ? AND path >= ? AND path < ?`, userID, from, to)
+	return err
+}
+
+// checkDestination verifies that a file or directory can be moved or copied from src to dst.
+func checkDestination(q dbtx, userID, src, dst string) (FileInfo, error) {
+	if src == "/" || dst == "/" {
+		return FileInfo{}, errInvalidPath
+	}
+	if err := checkWritable(dst); err != nil {
+		return FileInfo{}, err
+	}
+	fi, err := statPath(q, userID, src)
+	if err != nil {
+		return fi, err
+	}
+	if fi.IsDir() && isInside(dst, src) {
+		return fi, errInvalidPath
+	}
+	if _, err := statPath(q, userID, dst); err != errFileNotFound {
+		if err == nil {
+			return fi, errFileExists
+		}
+		return fi, err
+	}
+	return fi, ensureDirectories(q, userID, path.Dir(dst))
+}
+
+// movePath renames a file or directory. Directories are moved with everything inside them.
+func movePath(q dbtx, userID, src, dst string) error {
+	fi, err := checkDestination(q, userID, src, dst)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if _, err := q.Exec("UPDATE files SET path = ?, filename = ? WHERE id = ?", dst, path.Base(dst), fi.id); err != nil {
+			return err
+		}
+		return recordChange(q, userID, changeMove, fi.Type, dst, src)
+	}
+
+	from, to := prefixRange(childPrefix(src))
+	if _, err := q.Exec(`
+		UPDATE files SET path = ? || substr(path, length(?) + 1)
+		WHERE user_id = ? AND path >= ? AND path < ?`, dst, src, userID, from, to); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`
+		UPDATE directories SET path = ? || substr(path, length(?) + 1)
+		WHERE user_id = ? AND (path = ? OR path >= ? AND path < ?)`, dst, src, userID, src, from, to); err != nil {
+		return err
+	}
+	return recordChange(q, userID, changeMove, fi.Type, dst, src)
+}
+
+// copyFileByID duplicates a file, its content and its metadata at a new path.
+func copyFileByID(q dbtx, userID string, fileID int64, dst string) (int64, error) {
+	now := time.Now()
+	res, err := q.Exec(`
+		INSERT INTO files (user_id, path, filename, size, sha256, mime_type, created_at, modified_at)
+		SELECT user_id, ?, ?, size, sha256, mime_type, ?, modified_at FROM files WHERE id = ?`, dst, path.Base(dst), now, fileID)
+	if err != nil {
+		return 0, err
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := q.Exec(`
+		INSERT INTO file_content (file_id, chunk_index, content)
+		SELECT ?, chunk_index, content FROM file_content WHERE file_id = ?`, newID, fileID); err != nil {
+		return 0, err
+	}
+	if _, err := q.Exec("INSERT INTO file_attributes (file_id, key, value) SELECT ?, key, value FROM file_attributes WHERE file_id = ?", newID, fileID); err != nil {
+		return 0, err
+	}
+	_, err = q.Exec("INSERT INTO file_search (rowid, content) SELECT ?, content FROM file_search WHERE rowid = ?", newID, fileID)
+	return newID, err
+}
+
+// copyPath copies a file or directory. Directories are copied with everything inside them.
+// Copying from a mount imports the host files into the tree of the user.
+func copyPath(q dbtx, userID, src, dst string) error {
+	if m, rel, ok := findMount(src); ok {
+		return m.importPath(q, userID, rel, dst)
+	}
+	fi, err := checkDestination(q, userID, src, dst)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if _, err := copyFileByID(q, userID, fi.id, dst); err != nil {
+			return err
+		}
+		return recordChange(q, userID, changeCreate, fi.Type, dst, "")
+	}
+
+	from, to := prefixRange(childPrefix(src))
+	if _, err := q.Exec(`
+		INSERT INTO directories (user_id, path)
+		SELECT user_id, ? || substr(path, length(?) + 1) FROM directories
+		WHERE user_id = ? AND (path = ? OR path >= ? AND path < ?)`,
+		dst, src, userID, src, from, to); err != nil {
+		return err
+	}
+
+	files, err := walkFiles(q, userID, src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, err := copyFileByID(q, userID, f.id, dst+strings.TrimPrefix(f.Path, src)); err != nil {
+			return err
+		}
+	}
+	return recordChange(q, userID, changeCreate, fi.Type, dst, "")
+}
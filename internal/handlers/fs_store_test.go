@@ -0,0 +1,96 @@
+//go:build sqlite_fts5
+
+package handlers
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/sqlite3"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+)
+
+const testUserID = "test-user"
+
+// openTestDB returns a database in a temporary directory, with all migrations applied.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "portal.db")
+	m, err := migrate.New("file://../../db/migrations", "sqlite3://"+dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+		t.Fatal(srcErr, dbErr)
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func filePaths(t *testing.T, db *sql.DB, dir string) []string {
+	t.Helper()
+	files, err := walkFiles(db, testUserID, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+// Paths are case-sensitive: /A is not inside /a.
+func TestPrefixCaseSensitive(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(q dbtx) error
+		want []string
+	}{
+		{"delete", func(q dbtx) error { return removePath(q, testUserID, "/a", true) }, []string{"/A/y"}},
+		{"move", func(q dbtx) error { return movePath(q, testUserID, "/a", "/b") }, []string{"/A/y", "/b/x"}},
+		{"copy", func(q dbtx) error { return copyPath(q, testUserID, "/a", "/c") }, []string{"/A/y", "/a/x", "/c/x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			for _, p := range []string{"/a/x", "/A/y"} {
+				if _, err := createFile(db, testUserID, p, strings.NewReader(p)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			children, err := listDirectory(db, testUserID, "/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(children) != 1 || children[0].Path != "/a/x" {
+				t.Fatalf("listDirectory(/a) = %v, want /a/x", children)
+			}
+
+			if err := tt.run(db); err != nil {
+				t.Fatal(err)
+			}
+			if got := filePaths(t, db, "/"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files = %v, want %v", got, tt.want)
+			}
+			if _, err := statPath(db, testUserID, "/A"); err != nil {
+				t.Errorf("statPath(/A) = %v", err)
+			}
+		})
+	}
+}
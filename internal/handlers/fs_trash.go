@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Deleted files and directories are moved to the trash of their user, and purged after the retention period.
+
+const defaultTrashRetentionDays = 30
+
+// TrashItem is a file or directory in the trash.
+type TrashItem struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Path      string     `json:"path"` // Original path
+	Type      string     `json:"type"` // "file" | "directory"
+	Size      int64      `json:"size"`
+	DeletedAt time.Time  `json:"deleted_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	userID string
+}
+
+// prefix is the internal path the item was moved under.
+func (item TrashItem) prefix() string {
+	return fmt.Sprintf(".trash/%d", item.ID)
+}
+
+// loadTrashRetention reads how long items are kept in the trash from PORTAL_FS_TRASH_RETENTION_DAYS.
+// It returns 0 if items are kept until the trash is emptied.
+func loadTrashRetention() time.Duration {
+	days := defaultTrashRetentionDays
+	if n, err := strconv.Atoi(os.Getenv("PORTAL_FS_TRASH_RETENTION_DAYS")); err == nil && n >= 0 {
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// trashPath moves a file or directory to the trash. Directories are moved with everything inside them.
+func trashPath(q dbtx, userID, p string) (TrashItem, error) {
+	item := TrashItem{Path: p, Name: path.Base(p), DeletedAt: time.Now(), userID: userID}
+	if p == "/" {
+		return item, errInvalidPath
+	}
+	if err := checkWritable(p); err != nil {
+		return item, err
+	}
+	fi, err := statPath(q, userID, p)
+	if err != nil {
+		return item, err
+	}
+	item.Type, item.Size = fi.Type, fi.Size
+
+	from, to := prefixRange(childPrefix(p))
+	if fi.IsDir() {
+		err := q.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM files WHERE user_id = ? AND path >= ? AND path < ?`, userID, from, to).Scan(&item.Size)
+		if err != nil {
+			return item, err
+		}
+	}
+
+	res, err := q.Exec("INSERT INTO trash (user_id, path, type, size, deleted_at) VALUES (?, ?, ?, ?, ?)",
+		userID, item.Path, item.Type, item.Size, item.DeletedAt)
+	if err != nil {
+		return item, err
+	}
+	if item.ID, err = res.LastInsertId(); err != nil {
+		return item, err
+	}
+
+	if _, err := q.Exec(`
+		UPDATE files SET path = ? || path
+		WHERE user_id = ? AND (path = ? OR path >= ? AND path < ?)`, item.prefix(), userID, p, from, to); err != nil {
+		return item, err
+	}
+	if _, err := q.Exec(`
+		UPDATE directories SET path = ? || path
+		WHERE user_id = ? AND (path = ? OR path >= ? AND path < ?)`, item.prefix(), userID, p, from, to); err != nil {
+		return item, err
+	}
+	return item, recordChange(q, userID, changeDelete, item.Type, p, "")
+}
+
+func loadTrashItem(q dbtx, userID string, id int64) (TrashItem, error) {
+	item := TrashItem{ID: id, userID: userID}
+	err := q.QueryRow("SELECT path, type, size, deleted_at FROM trash WHERE id = ? AND user_id = ?", id, userID).
+		Scan(&item.Path, &item.Type, &item.Size, &item.DeletedAt)
+	if err == sql.ErrNoRows {
+		return item, errFileNotFound
+	}
+	item.Name = path.Base(item.Path)
+	return item, err
+}
+
+// listTrash returns the items in the trash of a user, most recently deleted first.
+func listTrash(q dbtx, userID string) ([]TrashItem, error) {
+	rows, err := q.Query("SELECT id, path, type, size, deleted_at FROM trash WHERE user_id = ? ORDER BY deleted_at DESC, id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	retention := loadTrashRetention()
+	items := []TrashItem{}
+	for rows.Next() {
+		item := TrashItem{userID: userID}
+		if err := rows.Scan(&item.ID, &item.Path, &item.Type, &item.Size, &item.DeletedAt); err != nil {
+			return nil, err
+		}
+		item.Name = path.Base(item.Path)
+		if retention > 0 {
+			expiresAt := item.DeletedAt.Add(retention)
+			item.ExpiresAt = &expiresAt
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// restoreTrashItem moves an item out of the trash, to its original path or to dst if not empty.
+func restoreTrashItem(q dbtx, item TrashItem, dst string) error {
+	if dst == "" {
+		dst = item.Path
+	}
+	if dst == "/" {
+		return errInvalidPath
+	}
+	if _, err := statPath(q, item.userID, dst); err != errFileNotFound {
+		if err == nil {
+			return errFileExists
+		}
+		return err
+	}
+	if err := ensureDirectories(q, item.userID, path.Dir(dst)); err != nil {
+		return err
+	}
+
+	src := item.prefix() + item.Path
+	from, to := prefixRange(src + "/")
+	if _, err := q.Exec(`
+		UPDATE files SET path = ? || substr(path, length(?) + 1)
+		WHERE user_id = ? AND (path = ? OR path >= ? AND path < ?)`, dst, src, item.userID, src, from, to); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`
+		UPDATE directories SET path = ? || substr(path, length(?) + 1)
+		WHERE user_id = ? AND (path = ? OR path >= ? AND path < ?)`, dst, src, item.userID, src, from, to); err != nil {
+		return err
+	}
+	if item.Type == fileTypeFile {
+		if _, err := q.Exec("UPDATE files SET filename = ? WHERE user_id = ? AND path = ?", path.Base(dst), item.userID, dst); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.Exec("DELETE FROM trash WHERE id = ?", item.ID); err != nil {
+		return err
+	}
+	return recordChange(q, item.userID, changeCreate, item.Type, dst, "")
+}
+
+// purgeTrashItem permanently deletes an item in the trash.
+func purgeTrashItem(q dbtx, item TrashItem) error {
+	if err := deletePrefix(q, item.userID, item.prefix()+"/"); err != nil {
+		return err
+	}
+	_, err := q.Exec("DELETE FROM trash WHERE id = ?", item.ID)
+	return err
+}
+
+// purgeTrash permanently deletes the items of a user deleted before the time.
+func purgeTrash(q dbtx, userID string, before time.Time) error {
+	items, err := listTrash(q, userID)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.DeletedAt.Before(before) {
+			if err := purgeTrashItem(q, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListTrashHandler lists the files and directories in the trash of a user
+func ListTrashHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		items, err := listTrash(db, c.QueryParam("user_id"))
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, items)
+	}
+}
+
+// RestoreTrashHandler restores a file or directory from the trash
+func RestoreTrashHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.FormValue("user_id")
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return respondFsError(c, errFileNotFound)
+		}
+		var dst string
+		if c.FormValue("path") != "" {
+			dst = normalizePath(c.FormValue("path"))
+		}
+
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			item, err := loadTrashItem(tx, userID, id)
+			if err != nil {
+				return err
+			}
+			return restoreTrashItem(tx, item, dst)
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.String(http.StatusOK, "Restored successfully")
+	}
+}
+
+// DeleteTrashItemHandler permanently deletes a file or directory in the trash
+func DeleteTrashItemHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return respondFsError(c, errFileNotFound)
+		}
+
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			item, err := loadTrashItem(tx, userID, id)
+			if err != nil {
+				return err
+			}
+			return purgeTrashItem(tx, item)
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.String(http.StatusOK, "Deleted permanently")
+	}
+}
+
+// EmptyTrashHandler permanently deletes everything in the trash of a user
+func EmptyTrashHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			items, err := listTrash(tx, userID)
+			if err != nil {
+				return err
+			}
+			for _, item := range items {
+				if err := purgeTrashItem(tx, item); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.String(http.StatusOK, "Trash emptied successfully")
+	}
+}
+
+// StartTrashPurgeAgent periodically deletes the items that have been in the trash longer than the retention period
+func StartTrashPurgeAgent(db *sql.DB) {
+	ticker := time.NewTicker(1 * time.Hour)
+	for ; true; <-ticker.C {
+		retention := loadTrashRetention()
+		if retention == 0 {
+			continue
+		}
+
+		rows, err := db.Query("SELECT DISTINCT user_id FROM trash")
+		if err != nil {
+			log.Error().Err(err).Msg("Error querying trash")
+			continue
+		}
+		var userIDs []string
+		for rows.Next() {
+			var userID string
+			if err := rows.Scan(&userID); err != nil {
+				log.Error().Err(err).Msg("Error scanning trash")
+				break
+			}
+			userIDs = append(userIDs, userID)
+		}
+		if err := rows.Close(); err != nil {
+			log.Error().Err(err).Msg("Error closing rows")
+		}
+
+		for _, userID := range userIDs {
+			err := inTransaction(db, func(tx *sql.Tx) error {
+				return purgeTrash(tx, userID, time.Now().Add(-retention))
+			})
+			if err != nil {
+				log.Error().Err(err).Msgf("Error purging trash of user %s", userID)
+			}
+		}
+	}
+}
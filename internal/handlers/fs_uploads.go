@@ -0,0 +1,423 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io/protocols/resumable-upload),
+// with the creation, termination and expiration extensions. Uploads expire when they haven't
+// received data for PORTAL_FS_UPLOAD_EXPIRY_HOURS, and are deleted by the upload purge agent.
+
+const (
+	tusVersion       = "1.0.0"
+	tusExtensions    = "creation,termination,expiration"
+	tusMaxSize       = 10 << 30 // 10GB
+	tusOffsetContent = "application/offset+octet-stream"
+
+	defaultUploadExpiryHours = 24
+)
+
+var errUploadOffset = errors.New("upload offset mismatch")
+
+type FileUpload struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Path      string    `json:"path"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Overwrite bool      `json:"overwrite"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	fileID int64
+}
+
+// loadUploadExpiry reads how long uploads are kept without receiving data from PORTAL_FS_UPLOAD_EXPIRY_HOURS.
+func loadUploadExpiry() time.Duration {
+	hours := defaultUploadExpiryHours
+	if n, err := strconv.Atoi(os.Getenv("PORTAL_FS_UPLOAD_EXPIRY_HOURS")); err == nil && n > 0 {
+		hours = n
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// loadUpload returns an upload. Expired uploads are not found, even before they are deleted.
+func loadUpload(q dbtx, id string) (FileUpload, error) {
+	u := FileUpload{ID: id}
+	err := q.QueryRow("SELECT user_id, file_id, path, length, offset, overwrite, created_at, expires_at FROM file_uploads WHERE id = ?", id).
+		Scan(&u.UserID, &u.fileID, &u.Path, &u.Length, &u.Offset, &u.Overwrite, &u.CreatedAt, &u.ExpiresAt)
+	if err == sql.ErrNoRows || (err == nil && time.Now().After(u.ExpiresAt)) {
+		return u, errFileNotFound
+	}
+	return u, err
+}
+
+// purgeExpiredUploads deletes the uploads that expired before the time, with the data received so far.
+func purgeExpiredUploads(q dbtx, before time.Time) error {
+	rows, err := q.Query("SELECT id, file_id, expires_at FROM file_uploads")
+	if err != nil {
+		return err
+	}
+	var expired []FileUpload
+	for rows.Next() {
+		var u FileUpload
+		if err := rows.Scan(&u.ID, &u.fileID, &u.ExpiresAt); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if u.ExpiresAt.Before(before) {
+			expired = append(expired, u)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, u := range expired {
+		if _, err := q.Exec("DELETE FROM file_uploads WHERE id = ?", u.ID); err != nil {
+			return err
+		}
+		if err := deleteFileByID(q, u.fileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartUploadPurgeAgent periodically deletes the expired uploads
+func StartUploadPurgeAgent(db *sql.DB) {
+	ticker := time.NewTicker(1 * time.Hour)
+	for ; true; <-ticker.C {
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			return purgeExpiredUploads(tx, time.Now())
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Error purging expired uploads")
+		}
+	}
+}
+
+// parseUploadMetadata parses the Upload-Metadata header: comma separated "key base64(value)" pairs.
+func parseUploadMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(value)
+	}
+	return metadata
+}
+
+func setTusHeaders(c echo.Context) {
+	c.Response().Header().Set("Tus-Resumable", tusVersion)
+	c.Response().Header().Set("Cache-Control", "no-store")
+}
+
+func setUploadExpires(c echo.Context, u FileUpload) {
+	c.Response().Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// appendUploadChunk appends data at the current offset of the upload, and sets its new expiry time.
+// The chunks of the staging file are kept full, so data first fills up the last chunk before new
+// chunks are added.
+func appendUploadChunk(q dbtx, u FileUpload, data []byte) error {
+	chunkIndex := u.Offset / fileChunkSize
+	if u.Offset%fileChunkSize == 0 {
+		if _, err := q.Exec("INSERT INTO file_content (file_id, chunk_index, content) VALUES (?, ?, ?)", u.fileID, chunkIndex, data); err != nil {
+			return err
+		}
+	} else {
+		// || returns TEXT, the chunk must stay a BLOB
+		if _, err := q.Exec("UPDATE file_content SET content = CAST(content || ? AS BLOB) WHERE file_id = ? AND chunk_index = ?", data, u.fileID, chunkIndex); err != nil {
+			return err
+		}
+	}
+
+	// The offset check makes concurrent PATCH requests for the same upload fail instead of interleaving
+	res, err := q.Exec("UPDATE file_uploads SET offset = ?, expires_at = ? WHERE id = ? AND offset = ?",
+		u.Offset+int64(len(data)), u.ExpiresAt, u.ID, u.Offset)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errUploadOffset
+	}
+	return nil
+}
+
+// finaliseUpload links the staging file of a completed upload to its target path. Existing files are
+// only replaced if the upload was created with overwrite, in which case they keep their ID and their
+// previous content becomes a version.
+func finaliseUpload(q dbtx, u FileUpload) error {
+	if _, err := q.Exec("DELETE FROM file_uploads WHERE id = ?", u.ID); err != nil {
+		return err
+	}
+
+	existing, err := statPath(q, u.UserID, u.Path)
+	switch {
+	case err == errFileNotFound:
+		if err := ensureDirectories(q, u.UserID, path.Dir(u.Path)); err != nil {
+			return err
+		}
+		now := time.Now()
+		if _, err := q.Exec("UPDATE files SET path = ?, filename = ?, size = ?, created_at = ?, modified_at = ? WHERE id = ?",
+			u.Path, path.Base(u.Path), u.Length, now, now, u.fileID); err != nil {
+			return err
+		}
+		if err := recordChange(q, u.UserID, changeCreate, fileTypeFile, u.Path, ""); err != nil {
+			return err
+		}
+		return finaliseUploadedContent(q, u.fileID)
+	case err != nil:
+		return err
+	case existing.IsDir():
+		return errIsDirectory
+	case !u.Overwrite:
+		return errFileExists
+	default:
+		if err := archiveFileContent(q, existing.id); err != nil {
+			return err
+		}
+		if _, err := q.Exec("UPDATE file_content SET file_id = ? WHERE file_id = ?", existing.id, u.fileID); err != nil {
+			return err
+		}
+		if _, err := q.Exec("UPDATE files SET size = ?, sha256 = NULL, modified_at = ? WHERE id = ?", u.Length, time.Now(), existing.id); err != nil {
+			return err
+		}
+		if _, err := q.Exec("DELETE FROM files WHERE id = ?", u.fileID); err != nil {
+			return err
+		}
+		if err := recordFileChange(q, existing.id, changeUpdate); err != nil {
+			return err
+		}
+		return finaliseUploadedContent(q, existing.id)
+	}
+}
+
+// finaliseUploadedContent computes the checksum and MIME type of the assembled content, and indexes it.
+func finaliseUploadedContent(q dbtx, fileID int64) error {
+	if _, err := fileChecksum(q, fileID); err != nil {
+		return err
+	}
+	if err := updateMimeType(q, fileID); err != nil {
+		return err
+	}
+	return indexFile(q, fileID)
+}
+
+// UploadOptionsHandler describes the supported tus protocol features
+func UploadOptionsHandler(c echo.Context) error {
+	c.Response().Header().Set("Tus-Resumable", tusVersion)
+	c.Response().Header().Set("Tus-Version", tusVersion)
+	c.Response().Header().Set("Tus-Extension", tusExtensions)
+	c.Response().Header().Set("Tus-Max-Size", strconv.Itoa(tusMaxSize))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// CreateUploadHandler creates a resumable upload. The user ID, target path and overwrite flag are read
+// from the Upload-Metadata header, or from the query parameters.
+func CreateUploadHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		setTusHeaders(c)
+
+		length, err := strconv.ParseInt(c.Request().Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return c.String(http.StatusBadRequest, "Invalid Upload-Length")
+		}
+		if length > tusMaxSize {
+			return c.String(http.StatusRequestEntityTooLarge, "Upload too large")
+		}
+
+		metadata := parseUploadMetadata(c.Request().Header.Get("Upload-Metadata"))
+		value := func(name string) string {
+			if v, ok := metadata[name]; ok {
+				return v
+			}
+			return c.QueryParam(name)
+		}
+
+		u := FileUpload{
+			ID:        uuid.New().String(),
+			UserID:    value("user_id"),
+			Path:      normalizePath(value("path")),
+			Length:    length,
+			Overwrite: value("overwrite") == "true",
+			ExpiresAt: time.Now().Add(loadUploadExpiry()),
+		}
+		if u.Path == "/" {
+			return respondFsError(c, errInvalidPath)
+		}
+
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			// Fail early if the upload could not be finalised
+			existing, err := statPath(tx, u.UserID, u.Path)
+			if err == nil && (existing.IsDir() || !u.Overwrite) {
+				return errFileExists
+			}
+			if err != nil && err != errFileNotFound {
+				return err
+			}
+
+			res, err := tx.Exec("INSERT INTO files (user_id, path, filename, size) VALUES (?, ?, ?, ?)",
+				u.UserID, ".uploads/"+u.ID, path.Base(u.Path), length)
+			if err != nil {
+				return err
+			}
+			if u.fileID, err = res.LastInsertId(); err != nil {
+				return err
+			}
+			_, err = tx.Exec("INSERT INTO file_uploads (id, user_id, file_id, path, length, overwrite, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				u.ID, u.UserID, u.fileID, u.Path, u.Length, u.Overwrite, u.ExpiresAt)
+			if err != nil {
+				return err
+			}
+
+			// Empty files are complete right away
+			if length == 0 {
+				return finaliseUpload(tx, u)
+			}
+			return nil
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		c.Response().Header().Set(echo.HeaderLocation, c.Request().URL.Path+"/"+u.ID)
+		c.Response().Header().Set("Upload-Offset", "0")
+		if length > 0 {
+			setUploadExpires(c, u)
+		}
+		return c.NoContent(http.StatusCreated)
+	}
+}
+
+// UploadOffsetHandler returns the current offset of a resumable upload
+func UploadOffsetHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		setTusHeaders(c)
+
+		u, err := loadUpload(db, c.Param("id"))
+		if err != nil {
+			if err == errFileNotFound {
+				return c.NoContent(http.StatusNotFound)
+			}
+			log.Error().Err(err).Msg("Failed to load upload")
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		c.Response().Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		c.Response().Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+		setUploadExpires(c, u)
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// UploadChunkHandler writes the request body at the offset given in the Upload-Offset header.
+// Data is persisted chunk by chunk, so an interrupted request can be resumed from the last stored offset.
+// The upload is finalised in the same transaction as its last chunk.
+func UploadChunkHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		setTusHeaders(c)
+
+		if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), tusOffsetContent) {
+			return c.String(http.StatusUnsupportedMediaType, "Content-Type must be "+tusOffsetContent)
+		}
+		offset, err := strconv.ParseInt(c.Request().Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid Upload-Offset")
+		}
+
+		u, err := loadUpload(db, c.Param("id"))
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		if offset != u.Offset {
+			return c.String(http.StatusConflict, "Upload-Offset does not match the current offset")
+		}
+		u.ExpiresAt = time.Now().Add(loadUploadExpiry())
+
+		// Read one byte past the remaining length to detect oversized bodies
+		body := io.LimitReader(c.Request().Body, u.Length-u.Offset+1)
+		buffer := make([]byte, fileChunkSize)
+		for u.Offset < u.Length {
+			n, readErr := io.ReadFull(body, buffer[:fileChunkSize-u.Offset%fileChunkSize])
+			if n > 0 {
+				if u.Offset+int64(n) > u.Length {
+					return c.String(http.StatusRequestEntityTooLarge, "Upload exceeds Upload-Length")
+				}
+				err := inTransaction(db, func(tx *sql.Tx) error {
+					if err := appendUploadChunk(tx, u, buffer[:n]); err != nil {
+						return err
+					}
+					if u.Offset+int64(n) == u.Length {
+						return finaliseUpload(tx, u)
+					}
+					return nil
+				})
+				if err == errUploadOffset {
+					return c.String(http.StatusConflict, "Upload-Offset does not match the current offset")
+				}
+				if err != nil {
+					return respondFsError(c, err)
+				}
+				u.Offset += int64(n)
+			}
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			}
+			if readErr != nil {
+				log.Error().Err(readErr).Msg("Upload interrupted")
+				c.Response().Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+				return c.NoContent(http.StatusBadRequest)
+			}
+		}
+
+		c.Response().Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		if u.Offset < u.Length {
+			setUploadExpires(c, u)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// DeleteUploadHandler terminates a resumable upload and removes the data received so far
+func DeleteUploadHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		setTusHeaders(c)
+
+		err := inTransaction(db, func(tx *sql.Tx) error {
+			u, err := loadUpload(tx, c.Param("id"))
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("DELETE FROM file_uploads WHERE id = ?", u.ID); err != nil {
+				return err
+			}
+			return deleteFileByID(tx, u.fileID)
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
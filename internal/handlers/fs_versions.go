@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Every update of a file archives its previous content as a version. Versions are numbered per file,
+// starting at 1, and the current content has the highest number.
+
+const defaultMaxFileVersions = 10
+
+var errVersionNotFound = errors.New("version not found")
+
+// FileVersion describes a version of a file.
+type FileVersion struct {
+	Version   int       `json:"version"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Current   bool      `json:"current"`
+
+	contentID int64 // files row holding the content
+}
+
+// versionRetention limits how many previous versions are kept per file, and for how long.
+type versionRetention struct {
+	MaxVersions int           // 0 keeps no history
+	MaxAge      time.Duration // 0 keeps versions regardless of age
+}
+
+// loadVersionRetention reads the version retention from PORTAL_FS_MAX_VERSIONS and PORTAL_FS_VERSION_MAX_AGE_DAYS.
+func loadVersionRetention() versionRetention {
+	retention := versionRetention{MaxVersions: defaultMaxFileVersions}
+	if n, err := strconv.Atoi(os.Getenv("PORTAL_FS_MAX_VERSIONS")); err == nil && n >= 0 {
+		retention.MaxVersions = n
+	}
+	if days, err := strconv.Atoi(os.Getenv("PORTAL_FS_VERSION_MAX_AGE_DAYS")); err == nil && days > 0 {
+		retention.MaxAge = time.Duration(days) * 24 * time.Hour
+	}
+	return retention
+}
+
+// archiveFileContent detaches the current content of a file into a new version, leaving the file
+// without content. The version number of the file is incremented.
+func archiveFileContent(q dbtx, fileID int64) error {
+	retention := loadVersionRetention()
+	if retention.MaxVersions == 0 {
+		if _, err := q.Exec("DELETE FROM file_content WHERE file_id = ?", fileID); err != nil {
+			return err
+		}
+	} else {
+		res, err := q.Exec(`
+			INSERT INTO files (user_id, path, filename, size, sha256, mime_type, created_at, modified_at)
+			SELECT user_id, '.versions/' || id || '/' || version, filename, size, sha256, mime_type, modified_at, modified_at
+			FROM files WHERE id = ?`, fileID)
+		if err != nil {
+			return err
+		}
+		contentID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec("UPDATE file_content SET file_id = ? WHERE file_id = ?", contentID, fileID); err != nil {
+			return err
+		}
+		if _, err := q.Exec("INSERT INTO file_versions (file_id, version, content_id) SELECT id, version, ? FROM files WHERE id = ?", contentID, fileID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.Exec("UPDATE files SET version = version + 1 WHERE id = ?", fileID); err != nil {
+		return err
+	}
+	return pruneFileVersions(q, fileID, retention)
+}
+
+// pruneFileVersions deletes the versions of a file exceeding the retention.
+func pruneFileVersions(q dbtx, fileID int64, retention versionRetention) error {
+	versions, err := listFileVersions(q, fileID)
+	if err != nil {
+		return err
+	}
+
+	kept := 0
+	for _, v := range versions {
+		if v.Current {
+			continue
+		}
+		if kept < retention.MaxVersions && (retention.MaxAge == 0 || time.Since(v.CreatedAt) <= retention.MaxAge) {
+			kept++
+			continue
+		}
+		if err := deleteFileVersion(q, fileID, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteFileVersion(q dbtx, fileID int64, v FileVersion) error {
+	if _, err := q.Exec("DELETE FROM file_versions WHERE file_id = ? AND version = ?", fileID, v.Version); err != nil {
+		return err
+	}
+	return deleteFileByID(q, v.contentID)
+}
+
+// deleteFileVersions deletes all previous versions of the files matching the condition on f,
+// e.g. "f.id = ?".
+func deleteFileVersions(q dbtx, condition string, args ...any) error {
+	contentIDs := `SELECT v.content_id FROM file_versions v JOIN files f ON v.file_id = f.id WHERE ` + condition
+	if _, err := q.Exec(`DELETE FROM file_content WHERE file_id IN (`+contentIDs+`)`, args...); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`DELETE FROM files WHERE id IN (`+contentIDs+`)`, args...); err != nil {
+		return err
+	}
+	_, err := q.Exec(`DELETE FROM file_versions WHERE file_id IN (SELECT f.id FROM files f WHERE `+condition+`)`, args...)
+	return err
+}
+
+// listFileVersions returns all versions of a file, the current version first.
+func listFileVersions(q dbtx, fileID int64) ([]FileVersion, error) {
+	rows, err := q.Query(`
+		SELECT version, id, size, sha256, modified_at, TRUE FROM files WHERE id = ?
+		UNION ALL
+		SELECT v.version, c.id, c.size, c.sha256, c.modified_at, FALSE
+		FROM file_versions v JOIN files c ON v.content_id = c.id
+		WHERE v.file_id = ?
+		ORDER BY 1 DESC`, fileID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	versions := []FileVersion{}
+	for rows.Next() {
+		var v FileVersion
+		var sum sql.NullString
+		if err := rows.Scan(&v.Version, &v.contentID, &v.Size, &sum, &v.CreatedAt, &v.Current); err != nil {
+			return nil, err
+		}
+		v.SHA256 = sum.String
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// findFileVersion returns a version of a file, which can be the current one.
+func findFileVersion(q dbtx, fileID int64, version int) (FileVersion, error) {
+	versions, err := listFileVersions(q, fileID)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+	return FileVersion{}, errVersionNotFound
+}
+
+// restoreFileVersion makes the content of a previous version the current content of the file.
+// The current content is archived first, so restoring doesn't lose anything.
+func restoreFileVersion(q dbtx, fileID int64, version int) error {
+	v, err := findFileVersion(q, fileID, version)
+	if err != nil {
+		return err
+	}
+	if v.Current {
+		return nil
+	}
+
+	if err := archiveFileContent(q, fileID); err != nil {
+		return err
+	}
+	if _, err := q.Exec(`
+		INSERT INTO file_content (file_id, chunk_index, content)
+		SELECT ?, chunk_index, content FROM file_content WHERE file_id = ?`, fileID, v.contentID); err != nil {
+		return err
+	}
+	_, err = q.Exec(`
+		UPDATE files SET size = ?, sha256 = ?, modified_at = ?, mime_type = (SELECT mime_type FROM files WHERE id = ?)
+		WHERE id = ?`, v.Size, sql.NullString{String: v.SHA256, Valid: v.SHA256 != ""}, time.Now(), v.contentID, fileID)
+	if err != nil {
+		return err
+	}
+	if err := recordFileChange(q, fileID, changeUpdate); err != nil {
+		return err
+	}
+	return indexFile(q, fileID)
+}
+
+// readVersionText returns the content of a version, if it's text small enough to be compared.
+func readVersionText(q dbtx, v FileVersion) (string, error) {
+	if v.Size > maxDiffSize {
+		return "", errNotText
+	}
+	content, err := io.ReadAll(fileContentReader(q, v.contentID))
+	if err != nil {
+		return "", err
+	}
+	if !isText(content) {
+		return "", errNotText
+	}
+	return string(content), nil
+}
+
+// parseVersion parses a version query parameter
+func parseVersion(value string) (int, error) {
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, errVersionNotFound
+	}
+	return version, nil
+}
+
+// ListVersionsHandler lists the versions of a file, the current version first
+func ListVersionsHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		filePath := normalizePath(c.Param("*"))
+
+		fileID, err := findFile(db, userID, filePath)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		versions, err := listFileVersions(db, fileID)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, versions)
+	}
+}
+
+// RestoreVersionHandler restores a previous version of a file, which becomes a new version
+func RestoreVersionHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.FormValue("user_id")
+		filePath := normalizePath(c.Param("*"))
+
+		version, err := parseVersion(c.FormValue("version"))
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		err = inTransaction(db, func(tx *sql.Tx) error {
+			fileID, err := findFile(tx, userID, filePath)
+			if err != nil {
+				return err
+			}
+			return restoreFileVersion(tx, fileID, version)
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		return c.String(http.StatusOK, "File restored successfully")
+	}
+}
+
+// DiffVersionsHandler compares two versions of a text file, returning a unified diff.
+// Without the "to" parameter, the version is compared with the current content.
+func DiffVersionsHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		filePath := normalizePath(c.Param("*"))
+
+		fileID, err := findFile(db, userID, filePath)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		versions, err := listFileVersions(db, fileID)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		from, err := parseVersion(c.QueryParam("from"))
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		to := versions[0].Version
+		if c.QueryParam("to") != "" {
+			if to, err = parseVersion(c.QueryParam("to")); err != nil {
+				return respondFsError(c, err)
+			}
+		}
+
+		texts := make([]string, 2)
+		for i, version := range []int{from, to} {
+			v, err := findFileVersion(db, fileID, version)
+			if err != nil {
+				return respondFsError(c, err)
+			}
+			if texts[i], err = readVersionText(db, v); err != nil {
+				return respondFsError(c, err)
+			}
+		}
+
+		diff := unifiedDiff(
+			fmt.Sprintf("%s (version %d)", filePath, from),
+			fmt.Sprintf("%s (version %d)", filePath, to),
+			texts[0], texts[1])
+		return c.String(http.StatusOK, diff)
+	}
+}
@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/webdav"
+)
+
+// The WebDAV endpoint exposes the files of each user on /dav/{user_id}/, on top of the same store as
+// the Files API. Deleted files are moved to the trash and updated files keep their previous versions.
+
+var webdavMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// davFileSystem implements webdav.FileSystem for the files of a user.
+type davFileSystem struct {
+	db     *sql.DB
+	userID string
+}
+
+// davError converts the errors of the file store to the errors expected by the WebDAV handler.
+func davError(err error) error {
+	switch err {
+	case errFileNotFound:
+		return os.ErrNotExist
+	case errFileExists:
+		return os.ErrExist
+	case errInvalidPath:
+		return os.ErrInvalid
+	}
+	return err
+}
+
+func (dfs *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return davError(inTransaction(dfs.db, func(tx *sql.Tx) error {
+		return makeDirectory(tx, dfs.userID, normalizePath(name), false)
+	}))
+}
+
+func (dfs *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p := normalizePath(name)
+	fi, err := statPath(dfs.db, dfs.userID, p)
+	if err != nil && err != errFileNotFound {
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !exists {
+			return nil, os.ErrNotExist
+		}
+		f := &davFile{fs: dfs, info: fi}
+		if !fi.IsDir() {
+			if f.content, err = openFileContent(dfs.db, fi.id); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	}
+
+	// Writes are buffered in a temporary file, and stored when the file is closed
+	switch {
+	case exists && fi.IsDir():
+		return nil, errIsDirectory
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, os.ErrNotExist
+	case !exists:
+		parent, err := statPath(dfs.db, dfs.userID, path.Dir(p))
+		if err != nil || !parent.IsDir() {
+			return nil, os.ErrNotExist
+		}
+		fi = FileInfo{Name: path.Base(p), Path: p, Type: fileTypeFile, CreatedAt: time.Now(), ModifiedAt: time.Now()}
+	}
+
+	tmp, err := os.CreateTemp("", "portal-dav-*")
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{fs: dfs, info: fi, tmp: tmp, hash: sha256.New()}, nil
+}
+
+func (dfs *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	return davError(inTransaction(dfs.db, func(tx *sql.Tx) error {
+		_, err := trashPath(tx, dfs.userID, normalizePath(name))
+		return err
+	}))
+}
+
+func (dfs *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return davError(inTransaction(dfs.db, func(tx *sql.Tx) error {
+		return movePath(tx, dfs.userID, normalizePath(oldName), normalizePath(newName))
+	}))
+}
+
+func (dfs *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := statPath(dfs.db, dfs.userID, normalizePath(name))
+	if err != nil {
+		return nil, davError(err)
+	}
+	return davFileInfo{FileInfo: fi, db: dfs.db}, nil
+}
+
+// davFileInfo implements os.FileInfo, webdav.ETager with the checksum of the content, and webdav.ContentTyper.
+type davFileInfo struct {
+	FileInfo
+	db  *sql.DB
+	sum string // Checksum of the content being written
+}
+
+func (fi davFileInfo) Name() string       { return fi.FileInfo.Name }
+func (fi davFileInfo) Size() int64        { return fi.FileInfo.Size }
+func (fi davFileInfo) ModTime() time.Time { return fi.ModifiedAt }
+func (fi davFileInfo) Sys() any           { return nil }
+
+func (fi davFileInfo) Mode() fs.FileMode {
+	if fi.FileInfo.IsDir() {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType returns the MIME type stored with the file, for the getcontenttype property.
+func (fi davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.MimeType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.MimeType, nil
+}
+
+func (fi davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.sum != "" {
+		return `"` + fi.sum + `"`, nil
+	}
+	if fi.FileInfo.IsDir() {
+		return "", webdav.ErrNotImplemented
+	}
+	sum, err := fileChecksum(fi.db, fi.id)
+	if err != nil {
+		return "", err
+	}
+	return `"` + sum + `"`, nil
+}
+
+// davFile is a file or directory opened for reading, or a file opened for writing.
+type davFile struct {
+	fs      *davFileSystem
+	info    FileInfo
+	content *chunkReadSeeker // Content of a file opened for reading
+	entries []FileInfo       // Remaining entries of a directory, loaded on the first Readdir
+	listed  bool
+
+	tmp  *os.File // Content of a file opened for writing
+	hash hash.Hash
+	size int64
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.content == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.content.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.content == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.content.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.tmp == nil {
+		return 0, os.ErrInvalid
+	}
+	n, err := f.tmp.Write(p)
+	f.hash.Write(p[:n])
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.info.IsDir() {
+		return nil, errNotDirectory
+	}
+	if !f.listed {
+		entries, err := listDirectory(f.fs.db, f.fs.userID, f.info.Path)
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.listed = entries, true
+	}
+
+	n := len(f.entries)
+	if count > 0 && count < n {
+		n = count
+	}
+	if count > 0 && n == 0 {
+		return nil, io.EOF
+	}
+	infos := make([]fs.FileInfo, n)
+	for i, entry := range f.entries[:n] {
+		infos[i] = davFileInfo{FileInfo: entry, db: f.fs.db}
+	}
+	f.entries = f.entries[n:]
+	return infos, nil
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	if f.tmp != nil {
+		info := f.info
+		info.Size = f.size
+		return davFileInfo{FileInfo: info, db: f.fs.db, sum: hex.EncodeToString(f.hash.Sum(nil))}, nil
+	}
+	return davFileInfo{FileInfo: f.info, db: f.fs.db}, nil
+}
+
+// Close stores the content written to the file, creating the file or adding a version.
+func (f *davFile) Close() error {
+	if f.tmp == nil {
+		return nil
+	}
+	defer func() {
+		if err := f.tmp.Close(); err != nil {
+			log.Error().Err(err).Msg("Error closing temporary file")
+		}
+		if err := os.Remove(f.tmp.Name()); err != nil {
+			log.Error().Err(err).Msg("Error removing temporary file")
+		}
+	}()
+
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return davError(inTransaction(f.fs.db, func(tx *sql.Tx) error {
+		fi, err := statPath(tx, f.fs.userID, f.info.Path)
+		if err == errFileNotFound {
+			_, err = createFile(tx, f.fs.userID, f.info.Path, f.tmp)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return errIsDirectory
+		}
+		return replaceFileContent(tx, fi.id, f.tmp)
+	}))
+}
+
+// davLocks holds the WebDAV locks of each user
+type davLocks struct {
+	mu    sync.Mutex
+	users map[string]webdav.LockSystem
+}
+
+func (l *davLocks) get(userID string) webdav.LockSystem {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.users[userID]
+	if !ok {
+		ls = webdav.NewMemLS()
+		l.users[userID] = ls
+	}
+	return ls
+}
+
+// WebDAVHandler serves the files of the user in the path over WebDAV
+func WebDAVHandler(db *sql.DB) echo.HandlerFunc {
+	locks := &davLocks{users: map[string]webdav.LockSystem{}}
+	return func(c echo.Context) error {
+		userID := c.Param("user_id")
+		handler := &webdav.Handler{
+			Prefix:     "/dav/" + userID,
+			FileSystem: &davFileSystem{db: db, userID: userID},
+			LockSystem: locks.get(userID),
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, webdav.ErrLocked) {
+					log.Error().Err(err).Msgf("WebDAV %s %s failed", r.Method, r.URL.Path)
+				}
+			},
+		}
+		handler.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+}
+
+// SetupWebDAVHandlers sets up the WebDAV endpoint
+func SetupWebDAVHandlers(davGroup *echo.Group, db *sql.DB) {
+	log.Info().Msg("Initializing WebDAV")
+
+	handler := WebDAVHandler(db)
+	davGroup.Match(webdavMethods, "/:user_id", handler)
+	davGroup.Match(webdavMethods, "/:user_id/*", handler)
+}
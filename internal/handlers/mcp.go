@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// The Model Context Protocol server exposes portal to MCP clients, on behalf of a user: the tools of the
+// registry as tools, the files as resources with portal://files/<path> URIs, and the chats as prompts
+// holding the messages of their active branch. Messages are JSON-RPC 2.0, served over stdio or HTTP.
+
+const (
+	mcpProtocolVersion = "2025-06-18"
+	mcpFilesURI        = "portal://files"
+	mcpPageSize        = 100
+	mcpMaxResourceSize = 10 * 1024 * 1024 // 10MB
+)
+
+// mcpProtocolVersions are the supported versions of the protocol, the latest first.
+var mcpProtocolVersions = []string{mcpProtocolVersion, "2025-03-26", "2024-11-05"}
+
+// JSON-RPC error codes
+const (
+	jsonrpcParseError       = -32700
+	jsonrpcInvalidRequest   = -32600
+	jsonrpcMethodNotFound   = -32601
+	jsonrpcInvalidParams    = -32602
+	jsonrpcInternalError    = -32603
+	mcpResourceNotFoundCode = -32002
+)
+
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"` // Missing in notifications
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *jsonrpcError) Error() string {
+	return e.Message
+}
+
+type mcpTool struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	InputSchema *toolSchema `json:"inputSchema"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpResource struct {
+	URI      string `json:"uri"`
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType,omitempty"`
+	Size     int64  `json:"size"`
+}
+
+type mcpResourceContents struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Blob     string `json:"blob,omitempty"` // Base64 encoded binary content
+}
+
+type mcpPrompt struct {
+	Name        string `json:"name"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type mcpPromptMessage struct {
+	Role    string     `json:"role"`
+	Content mcpContent `json:"content"`
+}
+
+// mcpServer answers the messages of a client. Tools, resources and prompts are those of the user.
+type mcpServer struct {
+	db      *sql.DB
+	server  http.Handler
+	userID  string
+	version string
+}
+
+// handle answers a message, a request or a notification, or a batch of them. It returns nil when
+// there is nothing to answer.
+func (s *mcpServer) handle(ctx context.Context, original *http.Request, data []byte) []byte {
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil || len(batch) == 0 {
+			return encodeResponse(jsonrpcResponse{Error: &jsonrpcError{jsonrpcInvalidRequest, "Invalid request"}})
+		}
+		var responses []json.RawMessage
+		for _, message := range batch {
+			if response := s.handle(ctx, original, message); response != nil {
+				responses = append(responses, response)
+			}
+		}
+		if len(responses) == 0 {
+			return nil
+		}
+		out, _ := json.Marshal(responses)
+		return out
+	}
+
+	var req jsonrpcRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return encodeResponse(jsonrpcResponse{Error: &jsonrpcError{jsonrpcParseError, "Parse error"}})
+	}
+	if req.Method == "" {
+		// Responses to requests of the server, which doesn't send any
+		return nil
+	}
+	result, err := s.call(ctx, original, req.Method, req.Params)
+	if len(req.ID) == 0 {
+		return nil
+	}
+	response := jsonrpcResponse{ID: req.ID, Result: result}
+	if err != nil {
+		var rpcErr *jsonrpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &jsonrpcError{jsonrpcInternalError, "Internal error"}
+			log.Error().Err(err).Str("method", req.Method).Msg("MCP request failed")
+		}
+		response.Result, response.Error = nil, rpcErr
+	}
+	return encodeResponse(response)
+}
+
+func encodeResponse(response jsonrpcResponse) []byte {
+	response.JSONRPC = "2.0"
+	if response.ID == nil {
+		response.ID = json.RawMessage("null")
+	}
+	out, err := json.Marshal(response)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode MCP response")
+		out, _ = json.Marshal(jsonrpcResponse{JSONRPC: "2.0", ID: response.ID, Error: &jsonrpcError{jsonrpcInternalError, "Internal error"}})
+	}
+	return out
+}
+
+// decodeParams decodes the parameters of a request, which can be missing.
+func decodeParams(params json.RawMessage, v any) error {
+	if len(compactJSON(params)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &jsonrpcError{jsonrpcInvalidParams, "Invalid params"}
+	}
+	return nil
+}
+
+// call runs a method and returns its result.
+func (s *mcpServer) call(ctx context.Context, original *http.Request, method string, params json.RawMessage) (any, error) {
+	var p struct {
+		ProtocolVersion string          `json:"protocolVersion"`
+		Name            string          `json:"name"`
+		Arguments       json.RawMessage `json:"arguments"`
+		URI             string          `json:"uri"`
+		Cursor          string          `json:"cursor"`
+	}
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case "initialize":
+		version := mcpProtocolVersion
+		if slices.Contains(mcpProtocolVersions, p.ProtocolVersion) {
+			version = p.ProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities": map[string]any{
+				"tools":     map[string]any{},
+				"resources": map[string]any{},
+				"prompts":   map[string]any{},
+			},
+			"serverInfo":   map[string]string{"name": "portal", "version": s.version},
+			"instructions": "Tools, files and chats of the portal server of the user.",
+		}, nil
+	case "ping", "notifications/initialized", "notifications/cancelled":
+		return map[string]any{}, nil
+	case "tools/list":
+		list := make([]mcpTool, 0, len(tools))
+		for _, t := range tools {
+			list = append(list, mcpTool{Name: t.name, Description: t.description, InputSchema: t.parameters})
+		}
+		return map[string]any{"tools": list}, nil
+	case "tools/call":
+		return s.callTool(ctx, original, p.Name, p.Arguments)
+	case "resources/list":
+		return s.listResources(p.Cursor)
+	case "resources/templates/list":
+		return map[string]any{"resourceTemplates": []map[string]string{{
+			"uriTemplate": mcpFilesURI + "{/path*}",
+			"name":        "file",
+			"title":       "File",
+			"description": "A file of the user, by path",
+		}}}, nil
+	case "resources/read":
+		return s.readResource(ctx, original, p.URI)
+	case "prompts/list":
+		return s.listPrompts(p.Cursor)
+	case "prompts/get":
+		return s.getPrompt(p.Name)
+	}
+	return nil, &jsonrpcError{jsonrpcMethodNotFound, "Method not found: " + method}
+}
+
+// callTool invokes a tool. Errors of the tool, including invalid arguments, are results for the model.
+func (s *mcpServer) callTool(ctx context.Context, original *http.Request, name string, args json.RawMessage) (any, error) {
+	result, err := invokeTool(ctx, s.server, original, name, args, s.userID)
+	if err == errToolNotFound {
+		return nil, &jsonrpcError{jsonrpcInvalidParams, "Unknown tool: " + name}
+	}
+	if errors.Is(err, errInvalidArguments) {
+		return map[string]any{"content": []mcpContent{{"text", err.Error()}}, "isError": true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	text := string(result.Result)
+	var str string
+	if json.Unmarshal(result.Result, &str) == nil {
+		text = str
+	}
+	return map[string]any{"content": []mcpContent{{"text", text}}, "isError": result.IsError}, nil
+}
+
+// mcpPage returns the bounds of the page of a list at the cursor, an offset, and the cursor of the next page.
+func mcpPage(cursor string, n int) (int, int, string, error) {
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil || start < 0 || start > n {
+			return 0, 0, "", &jsonrpcError{jsonrpcInvalidParams, "Invalid cursor"}
+		}
+	}
+	end := min(start+mcpPageSize, n)
+	next := ""
+	if end < n {
+		next = strconv.Itoa(end)
+	}
+	return start, end, next, nil
+}
+
+// fileURI returns the URI of the resource of a file, each element of the path escaped.
+func fileURI(p string) string {
+	var b strings.Builder
+	b.WriteString(mcpFilesURI)
+	for _, element := range strings.Split(strings.Trim(p, "/"), "/") {
+		b.WriteString("/" + url.PathEscape(element))
+	}
+	return b.String()
+}
+
+func (s *mcpServer) listResources(cursor string) (any, error) {
+	files, err := walkFiles(s.db, s.userID, "/")
+	if err != nil {
+		return nil, err
+	}
+	start, end, next, err := mcpPage(cursor, len(files))
+	if err != nil {
+		return nil, err
+	}
+	resources := make([]mcpResource, 0, end-start)
+	for _, fi := range files[start:end] {
+		resources = append(resources, mcpResource{URI: fileURI(fi.Path), Name: fi.Path, MimeType: fi.MimeType, Size: fi.Size})
+	}
+	result := map[string]any{"resources": resources}
+	if next != "" {
+		result["nextCursor"] = next
+	}
+	return result, nil
+}
+
+// readResource reads a file through the Files API: text files as text, other files as base64.
+func (s *mcpServer) readResource(ctx context.Context, original *http.Request, uri string) (any, error) {
+	p, ok := strings.CutPrefix(uri, mcpFilesURI+"/")
+	if !ok {
+		return nil, &jsonrpcError{mcpResourceNotFoundCode, "Resource not found"}
+	}
+	p, err := url.PathUnescape(p)
+	if err != nil {
+		return nil, &jsonrpcError{jsonrpcInvalidParams, "Invalid URI"}
+	}
+
+	req, err := apiRequest(http.MethodGet, filesPath("files", p), url.Values{"user_id": {s.userID}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+	if original != nil {
+		req.RemoteAddr = original.RemoteAddr
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", mcpMaxResourceSize-1))
+	rec := httptest.NewRecorder()
+	s.server.ServeHTTP(rec, req)
+
+	switch {
+	case rec.Code == http.StatusNotFound || rec.Code == http.StatusBadRequest:
+		return nil, &jsonrpcError{mcpResourceNotFoundCode, "Resource not found"}
+	case rec.Code == http.StatusRequestedRangeNotSatisfiable:
+		// Empty file
+		rec.Body.Reset()
+	case rec.Code == http.StatusPartialContent:
+		if _, total, _ := strings.Cut(rec.Header().Get("Content-Range"), "/"); total != strconv.Itoa(rec.Body.Len()) {
+			return nil, &jsonrpcError{jsonrpcInvalidParams, fmt.Sprintf("File larger than %dMB", mcpMaxResourceSize/1024/1024)}
+		}
+	case rec.Code != http.StatusOK:
+		return nil, fmt.Errorf("reading %s: status %d", p, rec.Code)
+	}
+
+	contents := mcpResourceContents{URI: fileURI(p), MimeType: rec.Header().Get(echo.HeaderContentType)}
+	mediaType, _, _ := mime.ParseMediaType(contents.MimeType)
+	if utf8.Valid(rec.Body.Bytes()) && (strings.HasPrefix(mediaType, "text/") || rec.Body.Len() == 0 ||
+		slices.Contains([]string{echo.MIMEApplicationJSON, echo.MIMEApplicationXML, "application/yaml", "application/javascript"}, mediaType)) {
+		contents.Text = rec.Body.String()
+	} else {
+		contents.Blob = base64.StdEncoding.EncodeToString(rec.Body.Bytes())
+	}
+	return map[string]any{"contents": []mcpResourceContents{contents}}, nil
+}
+
+func (s *mcpServer) listPrompts(cursor string) (any, error) {
+	rows, err := s.db.Query("SELECT id, title FROM chats WHERE user_id = ? ORDER BY timestamp DESC, id DESC", s.userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var prompts []mcpPrompt
+	for rows.Next() {
+		var prompt mcpPrompt
+		if err := rows.Scan(&prompt.Name, &prompt.Title); err != nil {
+			return nil, err
+		}
+		prompt.Description = "Chat: " + prompt.Title
+		prompts = append(prompts, prompt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	start, end, next, err := mcpPage(cursor, len(prompts))
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]any{"prompts": append([]mcpPrompt{}, prompts[start:end]...)}
+	if next != "" {
+		result["nextCursor"] = next
+	}
+	return result, nil
+}
+
+// getPrompt returns the messages of the active branch of a chat. MCP prompts only have user and
+// assistant messages, system messages are sent as user messages and tool messages are left out.
+func (s *mcpServer) getPrompt(chatID string) (any, error) {
+	chats, err := exportChats(s.db, s.userID, []string{chatID})
+	if err == errChatNotFound {
+		return nil, &jsonrpcError{jsonrpcInvalidParams, "Unknown prompt: " + chatID}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []mcpPromptMessage{}
+	for _, message := range chats[0].activeBranch() {
+		role := message.SenderRole
+		switch role {
+		case "assistant", "user":
+		case "system":
+			role = "user"
+		default:
+			continue
+		}
+		if message.Content == "" {
+			continue
+		}
+		messages = append(messages, mcpPromptMessage{Role: role, Content: mcpContent{"text", message.Content}})
+	}
+	return map[string]any{"description": chats[0].Title, "messages": messages}, nil
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// The MCP server is served with three transports:
+//   - stdio, by the portal mcp command: a message per line on stdin and stdout.
+//   - Streamable HTTP: POST /mcp answers each message in the response.
+//   - HTTP with server-sent events, for older clients: GET /mcp/sse opens a stream of events, whose first
+//     event gives the URL of the session where the client posts its messages. Answers are sent on the stream.
+//
+// Over HTTP, the user_id query parameter of /mcp and /mcp/sse sets the user.
+
+const mcpKeepAliveInterval = 30 * time.Second
+
+// RunMCP runs the portal mcp command, serving the MCP server on stdin and stdout until stdin is closed.
+// Tools call the API through the server, without listening on a port.
+func RunMCP(args []string, db *sql.DB, server http.Handler, version string) error {
+	flags := flag.NewFlagSet("mcp", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: portal mcp [flags]")
+		flags.PrintDefaults()
+	}
+	userID := flags.String("user", os.Getenv("PORTAL_MCP_USER_ID"), "ID of the user whose tools, files and chats are served (PORTAL_MCP_USER_ID)")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if *userID == "" {
+		flags.Usage()
+		return errors.New("a user ID is required")
+	}
+
+	// Stdout only carries the messages: the handlers called by tools print to stdout, which now goes to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+
+	s := &mcpServer{db: db, server: server, userID: *userID, version: version}
+	log.Info().Str("user_id", *userID).Msg("Serving MCP on stdio")
+	return serveMCP(context.Background(), s, os.Stdin, out)
+}
+
+// serveMCP answers the messages read from r, one per line, on w.
+func serveMCP(ctx context.Context, s *mcpServer, r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			if response := s.handle(ctx, nil, line); response != nil {
+				if _, err := w.Write(append(response, '\n')); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// mcpSession is a client connected to the stream of events of the HTTP with SSE transport.
+type mcpSession struct {
+	server *mcpServer
+	send   chan []byte
+	done   chan struct{}
+}
+
+type mcpSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*mcpSession
+}
+
+func (s *mcpSessions) get(id string) *mcpSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sessions[id]
+}
+
+func (s *mcpSessions) add(id string, session *mcpSession) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[id] = session
+}
+
+func (s *mcpSessions) remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if session, ok := s.sessions[id]; ok {
+		close(session.done)
+		delete(s.sessions, id)
+	}
+}
+
+func SetupMCPHandlers(group *echo.Group, db *sql.DB, server http.Handler, version string) {
+	log.Info().Msg("Initializing MCP server")
+
+	sessions := &mcpSessions{sessions: map[string]*mcpSession{}}
+	group.POST("", MCPHandler(db, server, version))
+	// The streamable HTTP transport doesn't open streams, clients fall back to POST
+	group.GET("", func(c echo.Context) error { return echo.ErrMethodNotAllowed })
+	group.GET("/sse", MCPEventsHandler(sessions, db, server, version))
+	group.POST("/messages", MCPMessageHandler(sessions))
+}
+
+// MCPHandler answers the messages of the streamable HTTP transport
+func MCPHandler(db *sql.DB, server http.Handler, version string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		if userID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "user_id is required"})
+		}
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+
+		s := &mcpServer{db: db, server: server, userID: userID, version: version}
+		response := s.handle(c.Request().Context(), c.Request(), body)
+		if response == nil {
+			return c.NoContent(http.StatusAccepted)
+		}
+		return c.JSONBlob(http.StatusOK, response)
+	}
+}
+
+// MCPEventsHandler opens the stream of events of a session of the HTTP with SSE transport
+func MCPEventsHandler(sessions *mcpSessions, db *sql.DB, server http.Handler, version string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		if userID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "user_id is required"})
+		}
+
+		id := uuid.New().String()
+		session := &mcpSession{
+			server: &mcpServer{db: db, server: server, userID: userID, version: version},
+			send:   make(chan []byte, 16),
+			done:   make(chan struct{}),
+		}
+		sessions.add(id, session)
+		defer sessions.remove(id)
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.Header().Set("Connection", "keep-alive")
+		res.WriteHeader(http.StatusOK)
+		endpoint := strings.TrimSuffix(c.Request().URL.Path, "/sse") + "/messages?session_id=" + id
+		if _, err := fmt.Fprintf(res, "event: endpoint\ndata: %s\n\n", endpoint); err != nil {
+			return nil
+		}
+		res.Flush()
+
+		ticker := time.NewTicker(mcpKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case message := <-session.send:
+				_, err = fmt.Fprintf(res, "event: message\ndata: %s\n\n", message)
+			case <-ticker.C:
+				_, err = io.WriteString(res, ": ping\n\n")
+			}
+			if err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
+
+// MCPMessageHandler receives a message of a session of the HTTP with SSE transport, answered on its stream
+func MCPMessageHandler(sessions *mcpSessions) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := sessions.get(c.QueryParam("session_id"))
+		if session == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+		}
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+
+		if response := session.server.handle(c.Request().Context(), c.Request(), body); response != nil {
+			select {
+			case session.send <- response:
+			case <-session.done:
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+			case <-c.Request().Context().Done():
+				return nil
+			}
+		}
+		return c.NoContent(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Previews are thumbnails of JPEG, PNG and GIF images, and excerpts of the text documents indexed by
+// the search. They are generated on the first request for a size and cached in the previews table,
+// for files of the Files API and objects of the Storage API.
+
+const (
+	previewSourceFile   = "file"
+	previewSourceObject = "object"
+
+	defaultPreviewSize  = 256
+	defaultPreviewChars = 500
+
+	maxPreviewSourceSize = 20 * 1024 * 1024 // Larger files have no preview
+	maxPreviewPixels     = 50 * 1000 * 1000 // Larger images are not decoded
+	previewJPEGQuality   = 80
+)
+
+// Previews are cached for each size, so the requested sizes are rounded up to one of these steps
+// to bound the number of previews of a file.
+var (
+	previewSizeSteps  = []int{64, 128, 256, 512, 1024}
+	previewCharsSteps = []int{100, 250, 500, 1000, 2500, 5000}
+)
+
+var (
+	errNoPreview          = errors.New("no preview available")
+	errPreviewTooLarge    = errors.New("too large to preview")
+	errInvalidPreviewSize = errors.New("invalid preview size")
+)
+
+// previewOptions is the requested size of a preview: the box thumbnails fit in, and the length of excerpts.
+type previewOptions struct {
+	Width  int
+	Height int
+	Chars  int
+}
+
+// variant identifies the previews generated with the options.
+func (opts previewOptions) variant() string {
+	return fmt.Sprintf("%dx%d,%d", opts.Width, opts.Height, opts.Chars)
+}
+
+// preview is a generated thumbnail or excerpt.
+type preview struct {
+	contentType string
+	data        []byte
+	etag        string
+	createdAt   time.Time
+}
+
+// parsePreviewOptions reads the width, height and chars query parameters, rounded up to the next step.
+// Sizes above the last step are reduced.
+func parsePreviewOptions(c echo.Context) (previewOptions, error) {
+	opts := previewOptions{Width: defaultPreviewSize, Height: defaultPreviewSize, Chars: defaultPreviewChars}
+	for _, param := range []struct {
+		name  string
+		value *int
+		steps []int
+	}{
+		{"width", &opts.Width, previewSizeSteps},
+		{"height", &opts.Height, previewSizeSteps},
+		{"chars", &opts.Chars, previewCharsSteps},
+	} {
+		value := c.QueryParam(param.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return opts, errInvalidPreviewSize
+		}
+		*param.value = param.steps[len(param.steps)-1]
+		for _, step := range param.steps {
+			if n <= step {
+				*param.value = step
+				break
+			}
+		}
+	}
+	return opts, nil
+}
+
+// loadPreview returns the cached preview of a file or object, generating it if it's missing or was
+// generated from a previous content. read returns the content of the source.
+func loadPreview(q dbtx, source string, sourceID int64, sourceETag, name string, opts previewOptions, read func() ([]byte, error)) (preview, error) {
+	p := preview{etag: fmt.Sprintf(`"%s-%s"`, sourceETag, opts.variant())}
+	var cachedETag string
+	err := q.QueryRow("SELECT source_etag, content_type, data, created_at FROM previews WHERE source = ? AND source_id = ? AND variant = ?",
+		source, sourceID, opts.variant()).Scan(&cachedETag, &p.contentType, &p.data, &p.createdAt)
+	if err == nil && cachedETag == sourceETag {
+		return p, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+
+	content, err := read()
+	if err != nil {
+		return p, err
+	}
+	if p.contentType, p.data, err = generatePreview(name, content, opts); err != nil {
+		return p, err
+	}
+	p.createdAt = time.Now()
+	_, err = q.Exec(`
+		INSERT OR REPLACE INTO previews (source, source_id, variant, source_etag, content_type, data, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, source, sourceID, opts.variant(), sourceETag, p.contentType, p.data, p.createdAt)
+	return p, err
+}
+
+// generatePreview returns a thumbnail of an image, or an excerpt of a text document.
+func generatePreview(name string, content []byte, opts previewOptions) (string, []byte, error) {
+	switch http.DetectContentType(content) {
+	case "image/jpeg", "image/png", "image/gif":
+		return imageThumbnail(content, opts)
+	}
+
+	kind := searchableType(path.Base(name), func() []byte { return content[:min(len(content), 512)] })
+	if kind == "" || !isText(content) {
+		return "", nil, errNoPreview
+	}
+	return "text/plain; charset=utf-8", []byte(textExcerpt(extractText(kind, content), opts.Chars)), nil
+}
+
+// imageThumbnail resizes an image to fit in the size of the options. Opaque images are encoded as JPEG,
+// images with transparency as PNG.
+func imageThumbnail(content []byte, opts previewOptions) (string, []byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return "", nil, errNoPreview
+	}
+	if config.Width*config.Height > maxPreviewPixels {
+		return "", nil, errPreviewTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return "", nil, errNoPreview
+	}
+
+	thumbnail := resizeImage(img, opts.Width, opts.Height)
+	var buf bytes.Buffer
+	if thumbnail.Opaque() {
+		err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: previewJPEGQuality})
+		return "image/jpeg", buf.Bytes(), err
+	}
+	err = png.Encode(&buf, thumbnail)
+	return "image/png", buf.Bytes(), err
+}
+
+// resizeImage scales an image down to fit in the box, keeping its aspect ratio. Each pixel of the
+// result is the average of the pixels it covers in the original. Images are never enlarged.
+func resizeImage(img image.Image, maxWidth, maxHeight int) *image.RGBA {
+	bounds := img.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	scale := min(float64(maxWidth)/float64(sw), float64(maxHeight)/float64(sh), 1)
+	dw := max(1, int(math.Round(float64(sw)*scale)))
+	dh := max(1, int(math.Round(float64(sh)*scale)))
+	if dw == sw && dh == sh {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := y * sh / dh
+		y1 := max((y+1)*sh/dh, y0+1)
+		for x := 0; x < dw; x++ {
+			x0 := x * sw / dw
+			x1 := max((x+1)*sw/dw, x0+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[src.PixOffset(x0, sy):src.PixOffset(x1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			i := dst.PixOffset(x, y)
+			for c := range sum {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// textExcerpt returns the beginning of a text, cut at a word boundary after at most chars characters.
+// Blank lines are dropped and an ellipsis marks truncated texts.
+func textExcerpt(text string, chars int) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimRightFunc(line, unicode.IsSpace); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	excerpt := []rune(strings.Join(lines, "\n"))
+	if len(excerpt) <= chars {
+		return string(excerpt)
+	}
+
+	cut := chars
+	for i := chars; i > chars/2; i-- {
+		if unicode.IsSpace(excerpt[i]) {
+			cut = i
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(excerpt[:cut]), unicode.IsSpace) + "…"
+}
+
+// servePreview writes a preview, handling conditional requests.
+func servePreview(c echo.Context, p preview) error {
+	c.Response().Header().Set("ETag", p.etag)
+	c.Response().Header().Set(echo.HeaderContentType, p.contentType)
+	http.ServeContent(c.Response(), c.Request(), "", p.createdAt, bytes.NewReader(p.data))
+	return nil
+}
+
+// FilePreviewHandler returns a thumbnail of an image file, or an excerpt of a text file
+func FilePreviewHandler(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.QueryParam("user_id")
+		filePath := normalizePath(c.Param("*"))
+		opts, err := parsePreviewOptions(c)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		fi, err := statPath(db, userID, filePath)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		if fi.IsDir() {
+			return respondFsError(c, errIsDirectory)
+		}
+		if fi.Size > maxPreviewSourceSize {
+			return respondFsError(c, errPreviewTooLarge)
+		}
+		sum, err := fileChecksum(db, fi.id)
+		if err != nil {
+			return respondFsError(c, err)
+		}
+
+		p, err := loadPreview(db, previewSourceFile, fi.id, sum, fi.Name, opts, func() ([]byte, error) {
+			return io.ReadAll(fileContentReader(db, fi.id))
+		})
+		if err != nil {
+			return respondFsError(c, err)
+		}
+		return servePreview(c, p)
+	}
+}
+
+// GetObjectPreview returns a thumbnail of an image object, or an excerpt of a text object
+func (a *API) GetObjectPreview(c echo.Context) error {
+	bucket := c.Param("bucket")
+	key := c.Param("key")
+	opts, err := parsePreviewOptions(c)
+	if err != nil {
+		return respondStorageError(c, &storageError{http.StatusBadRequest, "InvalidArgument", "Invalid preview size"})
+	}
+
+	var id, size int64
+	var etag string
+	err = a.db.QueryRow(`
+		SELECT o.id, o.etag, length(o.data)
+		FROM objects o
+		JOIN buckets b ON o.bucket_id = b.id
+		WHERE b.name = ? AND o.key = ?`, bucket, key).Scan(&id, &etag, &size)
+	if err == sql.ErrNoRows {
+		return respondStorageError(c, errNoSuchKey)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to query object")
+		return respondStorageError(c, errInternal)
+	}
+	if size > maxPreviewSourceSize {
+		return respondObjectPreviewError(c, errPreviewTooLarge)
+	}
+
+	p, err := loadPreview(a.db, previewSourceObject, id, strings.Trim(etag, `"`), key, opts, func() ([]byte, error) {
+		var data []byte
+		err := a.db.QueryRow("SELECT data FROM objects WHERE id = ?", id).Scan(&data)
+		return data, err
+	})
+	if err != nil {
+		return respondObjectPreviewError(c, err)
+	}
+	return servePreview(c, p)
+}
+
+// respondObjectPreviewError writes an error generating the preview of an object as an S3 error response.
+func respondObjectPreviewError(c echo.Context, err error) error {
+	switch err {
+	case errNoPreview:
+		return respondStorageError(c, &storageError{http.StatusUnsupportedMediaType, "InvalidRequest", "No preview is available for the object"})
+	case errPreviewTooLarge:
+		return respondStorageError(c, &storageError{http.StatusUnprocessableEntity, "InvalidRequest", "The object is too large to preview"})
+	}
+	log.Error().Err(err).Msg("Failed to generate preview")
+	return respondStorageError(c, errInternal)
+}
@@ -82,10 +82,18 @@ type ErrorResponse struct {
 }
 
 func (a *API) CreateBucket(c echo.Context) error {
+	if c.QueryParams().Has("object-lock") {
+		return a.PutObjectLockConfiguration(c)
+	}
+	if c.QueryParams().Has("cors") {
+		return a.PutBucketCors(c)
+	}
+
 	bucketName := c.Param("bucket")
+	lockEnabled := strings.EqualFold(c.Request().Header.Get("x-amz-bucket-object-lock-enabled"), "true")
 
 	// Insert the new bucket into the database
-	_, err := a.db.Exec("INSERT INTO buckets (name) VALUES (?)", bucketName)
+	_, err := a.db.Exec("INSERT INTO buckets (name, object_lock_enabled) VALUES (?, ?)", bucketName, lockEnabled)
 	if err != nil {
 		if strings.Contains(err.Error(), "Duplicate entry") {
 			return c.XML(http.StatusConflict, ErrorResponse{
@@ -107,6 +115,10 @@ func (a *API) CreateBucket(c echo.Context) error {
 }
 
 func (a *API) DeleteBucket(c echo.Context) error {
+	if c.QueryParams().Has("cors") {
+		return a.DeleteBucketCors(c)
+	}
+
 	bucketName := c.Param("bucket")
 
 	// Start a transaction to ensure atomicity
@@ -115,13 +127,47 @@ func (a *API) DeleteBucket(c echo.Context) error {
 		return c.XML(http.StatusInternalServerError, `<Error><Code>InternalError</Code><Message>Failed to start transaction</Message></Error>`)
 	}
 
-	// Delete all objects in the bucket
-	_, err = tx.Exec("DELETE FROM objects WHERE bucket_id = (SELECT id FROM buckets WHERE name = ?)", bucketName)
+	// Buckets with object lock are never emptied implicitly, their objects have to be
+	// deleted one by one so that retention and legal holds are enforced.
+	bucket, err := loadBucketLock(tx, bucketName)
+	if err != nil && err != errNoSuchBucket {
+		rollback(tx)
+		return errInternal.respond(c)
+	}
+	if bucket.Enabled {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM objects WHERE bucket_id = ?", bucket.ID).Scan(&count); err != nil {
+			rollback(tx)
+			return errInternal.respond(c)
+		}
+		if count > 0 {
+			rollback(tx)
+			return c.XML(http.StatusConflict, ErrorResponse{
+				Code:    "BucketNotEmpty",
+				Message: "The bucket you tried to delete is not empty",
+			})
+		}
+	}
+
+	// Delete all objects in the bucket, with their cached previews
+	_, err = tx.Exec(`
+		DELETE FROM previews WHERE source = ? AND source_id IN (
+			SELECT id FROM objects WHERE bucket_id = (SELECT id FROM buckets WHERE name = ?)
+		)`, previewSourceObject, bucketName)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM objects WHERE bucket_id = (SELECT id FROM buckets WHERE name = ?)", bucketName)
+	}
 	if err != nil {
 		rollback(tx)
 		return c.XML(http.StatusInternalServerError, `<Error><Code>InternalError</Code><Message>Failed to delete objects</Message></Error>`)
 	}
 
+	_, err = tx.Exec("DELETE FROM bucket_cors WHERE bucket_id = (SELECT id FROM buckets WHERE name = ?)", bucketName)
+	if err != nil {
+		rollback(tx)
+		return errInternal.respond(c)
+	}
+
 	// Delete the bucket itself
 	_, err = tx.Exec("DELETE FROM buckets WHERE name = ?", bucketName)
 	if err != nil {
@@ -149,6 +195,12 @@ func (a *API) UploadObject(c echo.Context) error {
 		fmt.Println("Initiating multipart upload...")
 		return a.InitiateMultipartUpload(c)
 	}
+	if c.QueryParams().Has("retention") {
+		return a.PutObjectRetention(c)
+	}
+	if c.QueryParams().Has("legal-hold") {
+		return a.PutObjectLegalHold(c)
+	}
 
 	// Normal object upload logic
 	file, err := c.FormFile("file")
@@ -176,24 +228,15 @@ func (a *API) UploadObject(c echo.Context) error {
 		return c.XML(http.StatusInternalServerError, `<Error><Code>InternalError</Code><Message>Failed to read file</Message></Error>`)
 	}
 
-	var bucketID int
-	err = a.db.QueryRow("SELECT id FROM buckets WHERE name = ?", bucket).Scan(&bucketID)
-	if err != nil {
-		return c.XML(http.StatusNotFound, `<Error><Code>NoSuchBucket</Code><Message>Bucket not found</Message></Error>`)
-	}
-
 	// Get the Content-Type from the multipart form data
 	contentType := file.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/octet-stream" // Default content type if not provided
 	}
 
-	// Calculate ETag
-	etag := fmt.Sprintf("%x", md5.Sum(buf.Bytes()))
-
-	_, err = a.db.Exec("INSERT INTO objects (bucket_id, key, data, content_type, created_at, etag) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, ?)", bucketID, key, buf.Bytes(), contentType, etag)
+	etag, err := a.storeObject(c, bucket, key, buf.Bytes(), contentType, nil)
 	if err != nil {
-		return c.XML(http.StatusInternalServerError, `<Error><Code>InternalError</Code><Message>Failed to save file</Message></Error>`)
+		return respondStorageError(c, err)
 	}
 
 	// Return XML response for successful upload
@@ -208,7 +251,67 @@ func (a *API) UploadObject(c echo.Context) error {
 	return c.XML(http.StatusOK, response)
 }
 
+// storeObject creates or replaces an object. The lock of a replaced object is enforced and the
+// new object gets the given lock, or without one the lock requested in the headers or the bucket default retention.
+func (a *API) storeObject(c echo.Context, bucketName, key string, data []byte, contentType string, lock *objectLock) (string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	bucket, err := loadBucketLock(tx, bucketName)
+	if err != nil {
+		rollback(tx)
+		return "", err
+	}
+	if err := checkObjectLock(tx, bucket.ID, key, bypassGovernance(c)); err != nil {
+		rollback(tx)
+		return "", err
+	}
+	if lock == nil {
+		l, err := objectLockFromRequest(c.Request().Header, bucket)
+		if err != nil {
+			rollback(tx)
+			return "", err
+		}
+		lock = &l
+	}
+
+	// Calculate ETag
+	etag := fmt.Sprintf("%x", md5.Sum(data))
+
+	_, err = tx.Exec(`
+		INSERT INTO objects (bucket_id, key, data, content_type, created_at, etag, retention_mode, retain_until, legal_hold)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+		ON CONFLICT(bucket_id, key) DO UPDATE SET
+			data = excluded.data,
+			content_type = excluded.content_type,
+			created_at = excluded.created_at,
+			etag = excluded.etag,
+			retention_mode = excluded.retention_mode,
+			retain_until = excluded.retain_until,
+			legal_hold = excluded.legal_hold`,
+		bucket.ID, key, data, sql.NullString{String: contentType, Valid: contentType != ""}, etag,
+		lock.Mode, lock.RetainUntil, lock.LegalHold)
+	if err != nil {
+		rollback(tx)
+		return "", err
+	}
+
+	return etag, tx.Commit()
+}
+
 func (a *API) GetObject(c echo.Context) error {
+	if c.QueryParams().Has("retention") {
+		return a.GetObjectRetention(c)
+	}
+	if c.QueryParams().Has("legal-hold") {
+		return a.GetObjectLegalHold(c)
+	}
+	if c.QueryParams().Has("preview") {
+		return a.GetObjectPreview(c)
+	}
+
 	bucket := c.Param("bucket")
 	key := c.Param("key")
 
@@ -216,12 +319,14 @@ func (a *API) GetObject(c echo.Context) error {
 	var contentType sql.NullString
 	var lastModified time.Time
 	var etag string
+	var lock objectLock
 
 	err := a.db.QueryRow(`
-		SELECT o.data, o.content_type, o.created_at, o.etag
+		SELECT o.data, o.content_type, o.created_at, o.etag, o.retention_mode, o.retain_until, o.legal_hold
 		FROM objects o
 		JOIN buckets b ON o.bucket_id = b.id
-		WHERE b.name = ? AND o.key = ?`, bucket, key).Scan(&data, &contentType, &lastModified, &etag)
+		WHERE b.name = ? AND o.key = ?`, bucket, key).Scan(&data, &contentType, &lastModified, &etag,
+		&lock.Mode, &lock.RetainUntil, &lock.LegalHold)
 
 	if err != nil {
 		fmt.Println("Error retrieving object:", err)
@@ -241,6 +346,7 @@ func (a *API) GetObject(c echo.Context) error {
 	c.Response().Header().Set(echo.HeaderContentLength, fmt.Sprintf("%d", contentLength))
 	c.Response().Header().Set("ETag", etag)
 	c.Response().Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	setObjectLockHeaders(c.Response().Header(), lock)
 
 	if c.Request().Method == http.MethodHead {
 		// For HEAD requests, return headers without the body
@@ -251,6 +357,13 @@ func (a *API) GetObject(c echo.Context) error {
 }
 
 func (a *API) ListObjects(c echo.Context) error {
+	if c.QueryParams().Has("object-lock") {
+		return a.GetObjectLockConfiguration(c)
+	}
+	if c.QueryParams().Has("cors") {
+		return a.GetBucketCors(c)
+	}
+
 	bucketName := c.Param("bucket")
 	delimiter := c.QueryParam("delimiter")
 	location := c.QueryParam("location")
@@ -370,27 +483,26 @@ func (a *API) DeleteObject(c echo.Context) error {
 	bucket := c.Param("bucket")
 	key := c.Param("key")
 
-	var bucketID int
-	err := a.db.QueryRow("SELECT id FROM buckets WHERE name = ?", bucket).Scan(&bucketID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.XML(http.StatusNotFound, ErrorResponse{
-				Code:    "NoSuchBucket",
-				Message: "The specified bucket does not exist",
-			})
+	// The lock is checked in the transaction of the delete, so it can't change in between
+	err := inTransaction(a.db, func(tx *sql.Tx) error {
+		b, err := loadBucketLock(tx, bucket)
+		if err != nil {
+			return err
 		}
-		return c.XML(http.StatusInternalServerError, ErrorResponse{
-			Code:    "InternalError",
-			Message: "Failed to retrieve bucket information",
-		})
-	}
-
-	_, err = a.db.Exec("DELETE FROM objects WHERE bucket_id = ? AND key = ?", bucketID, key)
+		if err := checkObjectLock(tx, b.ID, key, bypassGovernance(c)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			DELETE FROM previews WHERE source = ? AND source_id IN (
+				SELECT id FROM objects WHERE bucket_id = ? AND key = ?
+			)`, previewSourceObject, b.ID, key); err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM objects WHERE bucket_id = ? AND key = ?", b.ID, key)
+		return err
+	})
 	if err != nil {
-		return c.XML(http.StatusInternalServerError, ErrorResponse{
-			Code:    "InternalError",
-			Message: "Failed to delete object",
-		})
+		return respondStorageError(c, err)
 	}
 
 	// Return a 204 No Content response to indicate successful deletion
@@ -405,10 +517,9 @@ func (a *API) InitiateMultipartUpload(c echo.Context) error {
 	fmt.Println("Multipart Upload Initiated for:", bucket, key, "UploadID:", uploadID)
 
 	// Store the upload ID in the database
-	var bucketID int
-	err := a.db.QueryRow("SELECT id FROM buckets WHERE name = ?", bucket).Scan(&bucketID)
+	bucketConfig, err := loadBucketLock(a.db, bucket)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == errNoSuchBucket {
 			return c.XML(http.StatusNotFound, ErrorResponse{
 				Code:    "NoSuchBucket",
 				Message: "The specified bucket does not exist",
@@ -419,8 +530,15 @@ func (a *API) InitiateMultipartUpload(c echo.Context) error {
 			Message: "Failed to retrieve bucket information",
 		})
 	}
+	// The object lock headers are sent with the initiate request, the lock is applied on completion
+	lock, err := objectLockFromRequest(c.Request().Header, bucketConfig)
+	if err != nil {
+		return respondStorageError(c, err)
+	}
 
-	_, err = a.db.Exec("INSERT INTO multipart_uploads (bucket_id, key, upload_id) VALUES (?, ?, ?)", bucketID, key, uploadID)
+	_, err = a.db.Exec(`
+		INSERT INTO multipart_uploads (bucket_id, key, upload_id, retention_mode, retain_until, legal_hold)
+		VALUES (?, ?, ?, ?, ?, ?)`, bucketConfig.ID, key, uploadID, lock.Mode, lock.RetainUntil, lock.LegalHold)
 	if err != nil {
 		return c.XML(http.StatusInternalServerError, ErrorResponse{
 			Code:    "InternalError",
@@ -505,7 +623,9 @@ func (a *API) CompleteMultipartUpload(c echo.Context) error {
 
 	// Validate upload ID
 	var bucketID int
-	err := a.db.QueryRow("SELECT bucket_id FROM multipart_uploads WHERE upload_id = ?", uploadID).Scan(&bucketID)
+	var lock objectLock
+	err := a.db.QueryRow("SELECT bucket_id, retention_mode, retain_until, legal_hold FROM multipart_uploads WHERE upload_id = ?",
+		uploadID).Scan(&bucketID, &lock.Mode, &lock.RetainUntil, &lock.LegalHold)
 	if err != nil {
 		return c.XML(http.StatusNotFound, `<Error><Code>NoSuchUpload</Code></Error>`)
 	}
@@ -530,13 +650,10 @@ func (a *API) CompleteMultipartUpload(c echo.Context) error {
 		finalData.Write(partData)
 	}
 
-	// Calculate ETag for the final object
-	etag := fmt.Sprintf("%x", md5.Sum(finalData.Bytes()))
-
 	// Store the final object
-	_, err = a.db.Exec("INSERT INTO objects (bucket_id, key, data, etag) VALUES (?, ?, ?, ?)", bucketID, key, finalData.Bytes(), etag)
+	etag, err := a.storeObject(c, bucket, key, finalData.Bytes(), "", &lock)
 	if err != nil {
-		return c.XML(http.StatusInternalServerError, `<Error><Code>InternalError</Code></Error>`)
+		return respondStorageError(c, err)
 	}
 
 	// Cleanup
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+const maxCORSRules = 100
+
+type CORSConfiguration struct {
+	XMLName   xml.Name   `xml:"CORSConfiguration"`
+	CORSRules []CORSRule `xml:"CORSRule"`
+}
+
+type CORSRule struct {
+	ID             string   `xml:"ID,omitempty"`
+	AllowedOrigins []string `xml:"AllowedOrigin"`
+	AllowedMethods []string `xml:"AllowedMethod"`
+	AllowedHeaders []string `xml:"AllowedHeader,omitempty"`
+	ExposeHeaders  []string `xml:"ExposeHeader,omitempty"`
+	MaxAgeSeconds  int      `xml:"MaxAgeSeconds,omitempty"`
+}
+
+// wildcardMatch matches a value against a pattern containing at most one '*'.
+func wildcardMatch(pattern, value string) bool {
+	before, after, found := strings.Cut(pattern, "*")
+	if !found {
+		return pattern == value
+	}
+	return len(value) >= len(before)+len(after) && strings.HasPrefix(value, before) && strings.HasSuffix(value, after)
+}
+
+func (r CORSRule) allowsOrigin(origin string) bool {
+	for _, o := range r.AllowedOrigins {
+		if wildcardMatch(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r CORSRule) allowsMethod(method string) bool {
+	for _, m := range r.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (r CORSRule) allowsHeader(header string) bool {
+	for _, h := range r.AllowedHeaders {
+		if wildcardMatch(strings.ToLower(h), strings.ToLower(header)) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the first rule that allows the origin, method and request headers.
+func (config CORSConfiguration) match(origin, method string, headers []string) (CORSRule, bool) {
+	for _, rule := range config.CORSRules {
+		if !rule.allowsOrigin(origin) || !rule.allowsMethod(method) {
+			continue
+		}
+		allowed := true
+		for _, h := range headers {
+			if !rule.allowsHeader(h) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return rule, true
+		}
+	}
+	return CORSRule{}, false
+}
+
+func (config CORSConfiguration) validate() error {
+	if len(config.CORSRules) == 0 || len(config.CORSRules) > maxCORSRules {
+		return &storageError{http.StatusBadRequest, "MalformedXML", "A CORS configuration must have between 1 and 100 rules"}
+	}
+	for _, rule := range config.CORSRules {
+		if len(rule.AllowedOrigins) == 0 || len(rule.AllowedMethods) == 0 {
+			return &storageError{http.StatusBadRequest, "MalformedXML", "Each CORS rule requires an AllowedOrigin and an AllowedMethod"}
+		}
+		for _, m := range rule.AllowedMethods {
+			switch m {
+			case http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodHead:
+			default:
+				return &storageError{http.StatusBadRequest, "InvalidRequest", "Found unsupported HTTP method in CORS config: " + m}
+			}
+		}
+		for _, o := range rule.AllowedOrigins {
+			if strings.Count(o, "*") > 1 {
+				return &storageError{http.StatusBadRequest, "InvalidRequest", "AllowedOrigin can not have more than one wildcard: " + o}
+			}
+		}
+	}
+	return nil
+}
+
+// loadBucketCORS returns the CORS configuration of a bucket and whether it has one.
+func loadBucketCORS(q queryRower, bucket string) (CORSConfiguration, bool, error) {
+	var config CORSConfiguration
+	var document string
+	err := q.QueryRow(`
+		SELECT bc.configuration
+		FROM bucket_cors bc
+		JOIN buckets b ON bc.bucket_id = b.id
+		WHERE b.name = ?`, bucket).Scan(&document)
+	if err == sql.ErrNoRows {
+		return config, false, nil
+	}
+	if err != nil {
+		return config, false, err
+	}
+	if err := xml.Unmarshal([]byte(document), &config); err != nil {
+		return config, false, err
+	}
+	return config, true, nil
+}
+
+func (a *API) PutBucketCors(c echo.Context) error {
+	bucket, err := loadBucketLock(a.db, c.Param("bucket"))
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+
+	var config CORSConfiguration
+	if err := xml.NewDecoder(c.Request().Body).Decode(&config); err != nil {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "MalformedXML", Message: "The XML you provided was not well-formed"})
+	}
+	if err := config.validate(); err != nil {
+		return respondStorageError(c, err)
+	}
+
+	document, err := xml.Marshal(config)
+	if err != nil {
+		return errInternal.respond(c)
+	}
+
+	_, err = a.db.Exec(`
+		INSERT INTO bucket_cors (bucket_id, configuration) VALUES (?, ?)
+		ON CONFLICT(bucket_id) DO UPDATE SET configuration = excluded.configuration`, bucket.ID, string(document))
+	if err != nil {
+		return errInternal.respond(c)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (a *API) GetBucketCors(c echo.Context) error {
+	if _, err := loadBucketLock(a.db, c.Param("bucket")); err != nil {
+		return respondStorageError(c, err)
+	}
+
+	config, ok, err := loadBucketCORS(a.db, c.Param("bucket"))
+	if err != nil {
+		return errInternal.respond(c)
+	}
+	if !ok {
+		return c.XML(http.StatusNotFound, ErrorResponse{Code: "NoSuchCORSConfiguration", Message: "The CORS configuration does not exist"})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationXMLCharsetUTF8)
+	return c.XML(http.StatusOK, config)
+}
+
+func (a *API) DeleteBucketCors(c echo.Context) error {
+	bucket, err := loadBucketLock(a.db, c.Param("bucket"))
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+
+	if _, err := a.db.Exec("DELETE FROM bucket_cors WHERE bucket_id = ?", bucket.ID); err != nil {
+		return errInternal.respond(c)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Options answers OPTIONS requests that are not CORS preflight requests.
+// Routes have to exist for preflight requests, otherwise the bucket is not known to the middleware.
+func (a *API) Options(c echo.Context) error {
+	return c.NoContent(http.StatusNoContent)
+}
+
+// BucketCORS returns a middleware that evaluates the CORS configuration of the requested bucket,
+// both for preflight OPTIONS requests and for actual requests.
+func (a *API) BucketCORS(skipper middleware.Skipper) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			origin := req.Header.Get(echo.HeaderOrigin)
+			if skipper(c) || origin == "" || c.Param("bucket") == "" {
+				return next(c)
+			}
+
+			res := c.Response()
+			res.Header().Add(echo.HeaderVary, echo.HeaderOrigin)
+
+			config, ok, err := loadBucketCORS(a.db, c.Param("bucket"))
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to load bucket CORS configuration")
+			}
+
+			preflight := req.Method == http.MethodOptions && req.Header.Get(echo.HeaderAccessControlRequestMethod) != ""
+			if !preflight {
+				if ok {
+					if rule, matched := config.match(origin, req.Method, nil); matched {
+						res.Header().Set(echo.HeaderAccessControlAllowOrigin, origin)
+						if len(rule.ExposeHeaders) > 0 {
+							res.Header().Set(echo.HeaderAccessControlExposeHeaders, strings.Join(rule.ExposeHeaders, ", "))
+						}
+					}
+				}
+				return next(c)
+			}
+
+			res.Header().Add(echo.HeaderVary, echo.HeaderAccessControlRequestMethod)
+			res.Header().Add(echo.HeaderVary, echo.HeaderAccessControlRequestHeaders)
+
+			var headers []string
+			for _, h := range strings.Split(req.Header.Get(echo.HeaderAccessControlRequestHeaders), ",") {
+				if h = strings.TrimSpace(h); h != "" {
+					headers = append(headers, h)
+				}
+			}
+
+			rule, matched := config.match(origin, req.Header.Get(echo.HeaderAccessControlRequestMethod), headers)
+			if !ok || !matched {
+				return c.XML(http.StatusForbidden, ErrorResponse{Code: "AccessForbidden", Message: "CORSResponse: This CORS request is not allowed."})
+			}
+
+			res.Header().Set(echo.HeaderAccessControlAllowOrigin, origin)
+			res.Header().Set(echo.HeaderAccessControlAllowMethods, strings.Join(rule.AllowedMethods, ", "))
+			if len(headers) > 0 {
+				res.Header().Set(echo.HeaderAccessControlAllowHeaders, strings.Join(headers, ", "))
+			}
+			if len(rule.ExposeHeaders) > 0 {
+				res.Header().Set(echo.HeaderAccessControlExposeHeaders, strings.Join(rule.ExposeHeaders, ", "))
+			}
+			if rule.MaxAgeSeconds > 0 {
+				res.Header().Set(echo.HeaderAccessControlMaxAge, strconv.Itoa(rule.MaxAgeSeconds))
+			}
+			return c.NoContent(http.StatusOK)
+		}
+	}
+}
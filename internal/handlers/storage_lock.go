@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	retentionGovernance = "GOVERNANCE"
+	retentionCompliance = "COMPLIANCE"
+)
+
+type ObjectLockConfiguration struct {
+	XMLName           xml.Name        `xml:"ObjectLockConfiguration"`
+	ObjectLockEnabled string          `xml:"ObjectLockEnabled,omitempty"`
+	Rule              *ObjectLockRule `xml:"Rule,omitempty"`
+}
+
+type ObjectLockRule struct {
+	DefaultRetention DefaultRetention `xml:"DefaultRetention"`
+}
+
+type DefaultRetention struct {
+	Mode  string `xml:"Mode"`
+	Days  int    `xml:"Days,omitempty"`
+	Years int    `xml:"Years,omitempty"`
+}
+
+type ObjectRetention struct {
+	XMLName         xml.Name `xml:"Retention"`
+	Mode            string   `xml:"Mode"`
+	RetainUntilDate string   `xml:"RetainUntilDate"`
+}
+
+type ObjectLegalHold struct {
+	XMLName xml.Name `xml:"LegalHold"`
+	Status  string   `xml:"Status"`
+}
+
+// storageError is an S3 error that can be returned from helpers and written by the handler.
+type storageError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *storageError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *storageError) respond(c echo.Context) error {
+	return c.XML(e.Status, ErrorResponse{Code: e.Code, Message: e.Message})
+}
+
+var (
+	errNoSuchBucket = &storageError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey    = &storageError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errInternal     = &storageError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	errObjectLocked = &storageError{http.StatusForbidden, "AccessDenied", "Access Denied because object protected by object lock"}
+	errLockMissing  = &storageError{http.StatusBadRequest, "InvalidRequest", "Bucket is missing Object Lock Configuration"}
+)
+
+// respondStorageError writes err as an S3 error response.
+func respondStorageError(c echo.Context, err error) error {
+	if se, ok := err.(*storageError); ok {
+		return se.respond(c)
+	}
+	return errInternal.respond(c)
+}
+
+// bucketLock is the object lock configuration of a bucket.
+type bucketLock struct {
+	ID      int
+	Enabled bool
+	Mode    sql.NullString
+	Days    sql.NullInt64
+	Years   sql.NullInt64
+}
+
+// defaultRetention returns the retention applied to new objects in the bucket, if any.
+func (b bucketLock) defaultRetention(now time.Time) (string, time.Time, bool) {
+	if !b.Enabled || !b.Mode.Valid {
+		return "", time.Time{}, false
+	}
+	until := now.AddDate(int(b.Years.Int64), 0, int(b.Days.Int64))
+	return b.Mode.String, until, true
+}
+
+// objectLock is the retention and legal hold state of an object.
+type objectLock struct {
+	Mode        sql.NullString
+	RetainUntil sql.NullTime
+	LegalHold   bool
+}
+
+// protects reports whether the lock forbids deleting or overwriting the object.
+// Governance retention can be bypassed, compliance retention and legal holds cannot.
+func (l objectLock) protects(now time.Time, bypassGovernance bool) bool {
+	if l.LegalHold {
+		return true
+	}
+	if !l.RetainUntil.Valid || !l.RetainUntil.Time.After(now) {
+		return false
+	}
+	return l.Mode.String != retentionGovernance || !bypassGovernance
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func loadBucketLock(q queryRower, bucket string) (bucketLock, error) {
+	var b bucketLock
+	err := q.QueryRow(`
+		SELECT id, object_lock_enabled, default_retention_mode, default_retention_days, default_retention_years
+		FROM buckets WHERE name = ?`, bucket).Scan(&b.ID, &b.Enabled, &b.Mode, &b.Days, &b.Years)
+	if err == sql.ErrNoRows {
+		return b, errNoSuchBucket
+	}
+	return b, err
+}
+
+// loadObjectLock returns the lock state of an object and whether the object exists.
+func loadObjectLock(q queryRower, bucketID int, key string) (objectLock, bool, error) {
+	var l objectLock
+	err := q.QueryRow("SELECT retention_mode, retain_until, legal_hold FROM objects WHERE bucket_id = ? AND key = ?",
+		bucketID, key).Scan(&l.Mode, &l.RetainUntil, &l.LegalHold)
+	if err == sql.ErrNoRows {
+		return l, false, nil
+	}
+	if err != nil {
+		return l, false, err
+	}
+	return l, true, nil
+}
+
+// checkObjectLock is the single place that decides whether an existing object may be deleted
+// or replaced. Every path that removes or overwrites object data must call it first.
+func checkObjectLock(q queryRower, bucketID int, key string, bypassGovernance bool) error {
+	lock, exists, err := loadObjectLock(q, bucketID, key)
+	if err != nil {
+		return err
+	}
+	if exists && lock.protects(time.Now().UTC(), bypassGovernance) {
+		return errObjectLocked
+	}
+	return nil
+}
+
+func bypassGovernance(c echo.Context) bool {
+	return strings.EqualFold(c.Request().Header.Get("x-amz-bypass-governance-retention"), "true")
+}
+
+// objectLockFromRequest resolves the lock for a new object from the x-amz-object-lock-* headers,
+// falling back to the bucket default retention.
+func objectLockFromRequest(h http.Header, bucket bucketLock) (objectLock, error) {
+	var l objectLock
+	mode := strings.ToUpper(h.Get("x-amz-object-lock-mode"))
+	until := h.Get("x-amz-object-lock-retain-until-date")
+	hold := strings.ToUpper(h.Get("x-amz-object-lock-legal-hold"))
+
+	if mode == "" && until == "" && hold == "" {
+		if m, u, ok := bucket.defaultRetention(time.Now().UTC()); ok {
+			l.Mode = sql.NullString{String: m, Valid: true}
+			l.RetainUntil = sql.NullTime{Time: u.Truncate(time.Second), Valid: true}
+		}
+		return l, nil
+	}
+	if !bucket.Enabled {
+		return l, errLockMissing
+	}
+
+	if mode != "" || until != "" {
+		retention, err := parseRetention(mode, until)
+		if err != nil {
+			return l, err
+		}
+		l.Mode, l.RetainUntil = retention.Mode, retention.RetainUntil
+	} else if m, u, ok := bucket.defaultRetention(time.Now().UTC()); ok {
+		l.Mode = sql.NullString{String: m, Valid: true}
+		l.RetainUntil = sql.NullTime{Time: u.Truncate(time.Second), Valid: true}
+	}
+
+	switch hold {
+	case "":
+	case "ON":
+		l.LegalHold = true
+	case "OFF":
+		l.LegalHold = false
+	default:
+		return l, &storageError{http.StatusBadRequest, "InvalidArgument", "Legal hold status must be ON or OFF"}
+	}
+	return l, nil
+}
+
+func parseRetention(mode, until string) (objectLock, error) {
+	var l objectLock
+	if mode != retentionGovernance && mode != retentionCompliance {
+		return l, &storageError{http.StatusBadRequest, "InvalidArgument", "Unknown retention mode"}
+	}
+	t, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		return l, &storageError{http.StatusBadRequest, "InvalidArgument", "The retain until date must be in ISO 8601 format"}
+	}
+	if !t.After(time.Now()) {
+		return l, &storageError{http.StatusBadRequest, "InvalidArgument", "The retain until date must be in the future"}
+	}
+	l.Mode = sql.NullString{String: mode, Valid: true}
+	l.RetainUntil = sql.NullTime{Time: t.UTC().Truncate(time.Second), Valid: true}
+	return l, nil
+}
+
+func (a *API) PutObjectLockConfiguration(c echo.Context) error {
+	bucket, err := loadBucketLock(a.db, c.Param("bucket"))
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+
+	var config ObjectLockConfiguration
+	if err := xml.NewDecoder(c.Request().Body).Decode(&config); err != nil {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "MalformedXML", Message: "The XML you provided was not well-formed"})
+	}
+	if config.ObjectLockEnabled != "Enabled" {
+		if bucket.Enabled {
+			return c.XML(http.StatusConflict, ErrorResponse{Code: "InvalidBucketState", Message: "Object Lock cannot be disabled once enabled"})
+		}
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "MalformedXML", Message: "ObjectLockEnabled must be Enabled"})
+	}
+
+	var mode sql.NullString
+	var days, years sql.NullInt64
+	if config.Rule != nil {
+		r := config.Rule.DefaultRetention
+		if r.Mode != retentionGovernance && r.Mode != retentionCompliance {
+			return c.XML(http.StatusBadRequest, ErrorResponse{Code: "MalformedXML", Message: "Unknown default retention mode"})
+		}
+		if (r.Days > 0) == (r.Years > 0) {
+			return c.XML(http.StatusBadRequest, ErrorResponse{Code: "MalformedXML", Message: "Default retention requires either Days or Years"})
+		}
+		mode = sql.NullString{String: r.Mode, Valid: true}
+		days = sql.NullInt64{Int64: int64(r.Days), Valid: r.Days > 0}
+		years = sql.NullInt64{Int64: int64(r.Years), Valid: r.Years > 0}
+	}
+
+	_, err = a.db.Exec(`
+		UPDATE buckets
+		SET object_lock_enabled = TRUE, default_retention_mode = ?, default_retention_days = ?, default_retention_years = ?
+		WHERE id = ?`, mode, days, years, bucket.ID)
+	if err != nil {
+		return errInternal.respond(c)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (a *API) GetObjectLockConfiguration(c echo.Context) error {
+	bucket, err := loadBucketLock(a.db, c.Param("bucket"))
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+	if !bucket.Enabled {
+		return c.XML(http.StatusNotFound, ErrorResponse{
+			Code:    "ObjectLockConfigurationNotFoundError",
+			Message: "Object Lock configuration does not exist for this bucket",
+		})
+	}
+
+	config := ObjectLockConfiguration{ObjectLockEnabled: "Enabled"}
+	if bucket.Mode.Valid {
+		config.Rule = &ObjectLockRule{DefaultRetention: DefaultRetention{
+			Mode:  bucket.Mode.String,
+			Days:  int(bucket.Days.Int64),
+			Years: int(bucket.Years.Int64),
+		}}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationXMLCharsetUTF8)
+	return c.XML(http.StatusOK, config)
+}
+
+// lockedObject loads the bucket and the lock state of the requested object for the retention
+// and legal hold subresources.
+func (a *API) lockedObject(c echo.Context) (bucketLock, objectLock, error) {
+	bucket, err := loadBucketLock(a.db, c.Param("bucket"))
+	if err != nil {
+		return bucket, objectLock{}, err
+	}
+	if !bucket.Enabled {
+		return bucket, objectLock{}, errLockMissing
+	}
+	lock, exists, err := loadObjectLock(a.db, bucket.ID, c.Param("key"))
+	if err != nil {
+		return bucket, lock, err
+	}
+	if !exists {
+		return bucket, lock, errNoSuchKey
+	}
+	return bucket, lock, nil
+}
+
+func (a *API) PutObjectRetention(c echo.Context) error {
+	bucket, current, err := a.lockedObject(c)
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+
+	var retention ObjectRetention
+	if err := xml.NewDecoder(c.Request().Body).Decode(&retention); err != nil {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "MalformedXML", Message: "The XML you provided was not well-formed"})
+	}
+	next, err := parseRetention(retention.Mode, retention.RetainUntilDate)
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+
+	// Retention may always be extended, but shortening it or changing its mode is only
+	// allowed for governance retention with the bypass header.
+	now := time.Now().UTC()
+	if current.RetainUntil.Valid && current.RetainUntil.Time.After(now) {
+		weakened := next.RetainUntil.Time.Before(current.RetainUntil.Time) || next.Mode.String != current.Mode.String
+		if weakened && (current.Mode.String == retentionCompliance || !bypassGovernance(c)) {
+			return errObjectLocked.respond(c)
+		}
+	}
+
+	_, err = a.db.Exec("UPDATE objects SET retention_mode = ?, retain_until = ? WHERE bucket_id = ? AND key = ?",
+		next.Mode, next.RetainUntil, bucket.ID, c.Param("key"))
+	if err != nil {
+		return errInternal.respond(c)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (a *API) GetObjectRetention(c echo.Context) error {
+	_, lock, err := a.lockedObject(c)
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+	if !lock.RetainUntil.Valid {
+		return c.XML(http.StatusNotFound, ErrorResponse{Code: "NoSuchObjectLockConfiguration", Message: "The specified object does not have a retention configuration"})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationXMLCharsetUTF8)
+	return c.XML(http.StatusOK, ObjectRetention{
+		Mode:            lock.Mode.String,
+		RetainUntilDate: lock.RetainUntil.Time.UTC().Format(time.RFC3339),
+	})
+}
+
+func (a *API) PutObjectLegalHold(c echo.Context) error {
+	bucket, _, err := a.lockedObject(c)
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+
+	var hold ObjectLegalHold
+	if err := xml.NewDecoder(c.Request().Body).Decode(&hold); err != nil || (hold.Status != "ON" && hold.Status != "OFF") {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "MalformedXML", Message: "Legal hold status must be ON or OFF"})
+	}
+
+	_, err = a.db.Exec("UPDATE objects SET legal_hold = ? WHERE bucket_id = ? AND key = ?", hold.Status == "ON", bucket.ID, c.Param("key"))
+	if err != nil {
+		return errInternal.respond(c)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func (a *API) GetObjectLegalHold(c echo.Context) error {
+	_, lock, err := a.lockedObject(c)
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+
+	status := "OFF"
+	if lock.LegalHold {
+		status = "ON"
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationXMLCharsetUTF8)
+	return c.XML(http.StatusOK, ObjectLegalHold{Status: status})
+}
+
+// setObjectLockHeaders exposes the lock state of an object on GET and HEAD responses.
+func setObjectLockHeaders(h http.Header, l objectLock) {
+	if l.RetainUntil.Valid {
+		h.Set("x-amz-object-lock-mode", l.Mode.String)
+		h.Set("x-amz-object-lock-retain-until-date", l.RetainUntil.Time.UTC().Format(time.RFC3339))
+	}
+	if l.LegalHold {
+		h.Set("x-amz-object-lock-legal-hold", "ON")
+	}
+}
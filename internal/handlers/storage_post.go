@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxPostObjectMemory = 32 << 20 // 32MB, larger files are buffered on disk
+	postPolicyRegion    = "us-east-1"
+)
+
+// PostPolicy is the policy document of a browser POST upload.
+type PostPolicy struct {
+	Expiration string            `json:"expiration"`
+	Conditions []json.RawMessage `json:"conditions"`
+}
+
+// PostPolicyRequest describes the restrictions of a server-issued POST policy.
+type PostPolicyRequest struct {
+	KeyPrefix             string `json:"key_prefix"`
+	ContentType           string `json:"content_type"` // Prefix match, e.g. "image/"
+	MinSize               int64  `json:"min_size"`
+	MaxSize               int64  `json:"max_size"`
+	ExpiresIn             int    `json:"expires_in"` // Seconds, defaults to one hour
+	SuccessActionStatus   string `json:"success_action_status"`
+	SuccessActionRedirect string `json:"success_action_redirect"`
+}
+
+// PostPolicyResponse contains the form fields a browser has to submit along with the file.
+type PostPolicyResponse struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+type storageCredentials struct {
+	AccessKey string
+	SecretKey string
+}
+
+func loadStorageCredentials() (storageCredentials, bool) {
+	creds := storageCredentials{
+		AccessKey: os.Getenv("PORTAL_STORAGE_ACCESS_KEY"),
+		SecretKey: os.Getenv("PORTAL_STORAGE_SECRET_KEY"),
+	}
+	return creds, creds.AccessKey != "" && creds.SecretKey != ""
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signPolicyV4 signs a base64 encoded policy with the AWS Signature Version 4 signing key.
+func signPolicyV4(secretKey, date, region, policy string) string {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, policy))
+}
+
+// signPolicyV2 signs a base64 encoded policy with the legacy AWS Signature Version 2.
+func signPolicyV2(secretKey, policy string) string {
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte(policy))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPostSignature checks the signature of the policy in the form, supporting both
+// Signature Version 4 (x-amz-signature) and Version 2 (signature) forms.
+func verifyPostSignature(form url.Values, creds storageCredentials) bool {
+	policy := formValue(form, "policy")
+
+	if formValue(form, "x-amz-algorithm") != "" {
+		if formValue(form, "x-amz-algorithm") != "AWS4-HMAC-SHA256" {
+			return false
+		}
+		// <access-key>/<date>/<region>/s3/aws4_request
+		parts := strings.Split(formValue(form, "x-amz-credential"), "/")
+		if len(parts) != 5 || parts[0] != creds.AccessKey || parts[3] != "s3" || parts[4] != "aws4_request" {
+			return false
+		}
+		expected := signPolicyV4(creds.SecretKey, parts[1], parts[2], policy)
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(formValue(form, "x-amz-signature"))) == 1
+	}
+
+	if formValue(form, "AWSAccessKeyId") != creds.AccessKey {
+		return false
+	}
+	expected := signPolicyV2(creds.SecretKey, policy)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(formValue(form, "signature"))) == 1
+}
+
+// formValue returns a form field by name, ignoring case as S3 does.
+func formValue(form url.Values, name string) string {
+	for k, v := range form {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// checkPostPolicy validates the form fields and the file size against the policy conditions.
+// As in S3, every form field except the signature fields must be covered by a condition.
+func checkPostPolicy(policy PostPolicy, form url.Values, size int64, now time.Time) error {
+	expiration, err := time.Parse(time.RFC3339, policy.Expiration)
+	if err != nil {
+		return fmt.Errorf("invalid policy expiration")
+	}
+	if now.After(expiration) {
+		return fmt.Errorf("policy expired")
+	}
+
+	covered := map[string]bool{}
+	for _, raw := range policy.Conditions {
+		var exact map[string]string
+		if err := json.Unmarshal(raw, &exact); err == nil {
+			for field, value := range exact {
+				field = strings.ToLower(field)
+				if formValue(form, field) != value {
+					return fmt.Errorf("policy condition failed: [\"eq\", \"$%s\", %q]", field, value)
+				}
+				covered[field] = true
+			}
+			continue
+		}
+
+		var cond []any
+		if err := json.Unmarshal(raw, &cond); err != nil || len(cond) != 3 {
+			return fmt.Errorf("invalid policy condition: %s", raw)
+		}
+		op, _ := cond[0].(string)
+		op = strings.ToLower(op)
+		switch op {
+		case "content-length-range":
+			minSize, ok1 := cond[1].(float64)
+			maxSize, ok2 := cond[2].(float64)
+			if !ok1 || !ok2 {
+				return fmt.Errorf("invalid policy condition: %s", raw)
+			}
+			if size < int64(minSize) {
+				return fmt.Errorf("your proposed upload is smaller than the minimum allowed size")
+			}
+			if size > int64(maxSize) {
+				return fmt.Errorf("your proposed upload exceeds the maximum allowed size")
+			}
+		case "eq", "starts-with":
+			field, ok1 := cond[1].(string)
+			value, ok2 := cond[2].(string)
+			if !ok1 || !ok2 || !strings.HasPrefix(field, "$") {
+				return fmt.Errorf("invalid policy condition: %s", raw)
+			}
+			field = strings.ToLower(strings.TrimPrefix(field, "$"))
+			actual := formValue(form, field)
+			if op == "eq" && actual != value || op == "starts-with" && !strings.HasPrefix(actual, value) {
+				return fmt.Errorf("policy condition failed: [%q, \"$%s\", %q]", op, field, value)
+			}
+			covered[field] = true
+		default:
+			return fmt.Errorf("invalid policy condition: %s", raw)
+		}
+	}
+
+	for field := range form {
+		name := strings.ToLower(field)
+		switch {
+		case name == "policy", name == "x-amz-signature", name == "signature", name == "awsaccesskeyid", name == "file", name == "bucket":
+		case strings.HasPrefix(name, "x-ignore-"):
+		case !covered[name]:
+			return fmt.Errorf("extra input fields: %s", field)
+		}
+	}
+	return nil
+}
+
+// PostObject handles browser uploads with a signed policy document (S3 POST Object).
+func (a *API) PostObject(c echo.Context) error {
+	bucket := c.Param("bucket")
+
+	creds, ok := loadStorageCredentials()
+	if !ok {
+		return c.XML(http.StatusForbidden, ErrorResponse{Code: "AccessDenied", Message: "POST uploads require storage credentials to be configured"})
+	}
+
+	if err := c.Request().ParseMultipartForm(maxPostObjectMemory); err != nil {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "MalformedPOSTRequest", Message: "The body of your POST request is not well-formed multipart/form-data"})
+	}
+	form := url.Values(c.Request().MultipartForm.Value)
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "InvalidArgument", Message: "POST requires exactly one file upload per request"})
+	}
+
+	encodedPolicy := formValue(form, "policy")
+	if encodedPolicy == "" || !verifyPostSignature(form, creds) {
+		return c.XML(http.StatusForbidden, ErrorResponse{Code: "SignatureDoesNotMatch", Message: "The request signature we calculated does not match the signature you provided"})
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encodedPolicy)
+	if err != nil {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "InvalidPolicyDocument", Message: "Invalid Policy: Invalid base64 encoding"})
+	}
+	var policy PostPolicy
+	if err := json.Unmarshal(decoded, &policy); err != nil {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "InvalidPolicyDocument", Message: "Invalid Policy: Invalid JSON"})
+	}
+
+	// The bucket is part of the URL but policy conditions refer to it like a form field
+	form.Set("bucket", bucket)
+	key := strings.ReplaceAll(formValue(form, "key"), "${filename}", file.Filename)
+	form.Set("key", key)
+	if key == "" {
+		return c.XML(http.StatusBadRequest, ErrorResponse{Code: "InvalidArgument", Message: "Bucket POST must contain a field named 'key'"})
+	}
+
+	if err := checkPostPolicy(policy, form, file.Size, time.Now().UTC()); err != nil {
+		return c.XML(http.StatusForbidden, ErrorResponse{Code: "AccessDenied", Message: "Invalid according to Policy: " + err.Error()})
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return errInternal.respond(c)
+	}
+	defer func() {
+		if cerr := src.Close(); cerr != nil {
+			log.Error().Err(cerr).Msg("Error closing file")
+		}
+	}()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, src); err != nil {
+		return errInternal.respond(c)
+	}
+
+	contentType := formValue(form, "Content-Type")
+	if contentType == "" {
+		contentType = file.Header.Get("Content-Type")
+	}
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+
+	etag, err := a.storeObject(c, bucket, key, buf.Bytes(), contentType, nil)
+	if err != nil {
+		return respondStorageError(c, err)
+	}
+
+	if redirect := formValue(form, "success_action_redirect"); redirect != "" {
+		if target, err := url.Parse(redirect); err == nil {
+			q := target.Query()
+			q.Set("bucket", bucket)
+			q.Set("key", key)
+			q.Set("etag", `"`+etag+`"`)
+			target.RawQuery = q.Encode()
+			return c.Redirect(http.StatusSeeOther, target.String())
+		}
+	}
+
+	c.Response().Header().Set("ETag", `"`+etag+`"`)
+	switch formValue(form, "success_action_status") {
+	case "200":
+		return c.NoContent(http.StatusOK)
+	case "201":
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationXMLCharsetUTF8)
+		return c.XML(http.StatusCreated, struct {
+			XMLName  xml.Name `xml:"PostResponse"`
+			Location string   `xml:"Location"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			ETag     string   `xml:"ETag"`
+		}{
+			Location: fmt.Sprintf("%s://%s/api/storage/%s/%s", c.Scheme(), c.Request().Host, bucket, strings.ReplaceAll(url.PathEscape(key), "%2F", "/")),
+			Bucket:   bucket,
+			Key:      key,
+			ETag:     `"` + etag + `"`,
+		})
+	default:
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// CreatePostPolicy issues a signed policy that lets a browser upload directly to a bucket.
+func (a *API) CreatePostPolicy(c echo.Context) error {
+	bucket := c.Param("bucket")
+
+	creds, ok := loadStorageCredentials()
+	if !ok {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Storage credentials are not configured"})
+	}
+
+	if _, err := loadBucketLock(a.db, bucket); err != nil {
+		if err == errNoSuchBucket {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Bucket not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	req := new(PostPolicyRequest)
+	if err := c.Bind(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.ExpiresIn <= 0 {
+		req.ExpiresIn = 3600
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	fields := map[string]string{
+		"key":              req.KeyPrefix + "${filename}",
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKey, date, postPolicyRegion),
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+
+	conditions := []any{
+		map[string]string{"bucket": bucket},
+		[]string{"starts-with", "$key", req.KeyPrefix},
+		map[string]string{"x-amz-algorithm": fields["x-amz-algorithm"]},
+		map[string]string{"x-amz-credential": fields["x-amz-credential"]},
+		map[string]string{"x-amz-date": fields["x-amz-date"]},
+		[]string{"starts-with", "$Content-Type", req.ContentType},
+	}
+	if req.MaxSize > 0 {
+		conditions = append(conditions, []any{"content-length-range", req.MinSize, req.MaxSize})
+	}
+	if req.SuccessActionStatus != "" {
+		fields["success_action_status"] = req.SuccessActionStatus
+		conditions = append(conditions, map[string]string{"success_action_status": req.SuccessActionStatus})
+	}
+	if req.SuccessActionRedirect != "" {
+		fields["success_action_redirect"] = req.SuccessActionRedirect
+		conditions = append(conditions, map[string]string{"success_action_redirect": req.SuccessActionRedirect})
+	}
+
+	policy, err := json.Marshal(map[string]any{
+		"expiration": now.Add(time.Duration(req.ExpiresIn) * time.Second).Format(time.RFC3339),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+	fields["x-amz-signature"] = signPolicyV4(creds.SecretKey, date, postPolicyRegion, fields["policy"])
+
+	return c.JSON(http.StatusOK, PostPolicyResponse{
+		URL:    fmt.Sprintf("%s://%s/api/storage/%s", c.Scheme(), c.Request().Host, bucket),
+		Fields: fields,
+	})
+}
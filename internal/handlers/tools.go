@@ -0,0 +1,565 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Tools expose the services of portal to models, as functions they can call. Each tool describes its
+// arguments with a JSON Schema and turns them into a request to the API, which is served by the same
+// handlers as any other request. Invocations can be recorded in the tools of a chat message, next to
+// the tool call of the model.
+
+// maxToolResultSize is the maximum size of the result of a tool, larger text results are truncated.
+const maxToolResultSize = 64 * 1024
+
+var (
+	errToolNotFound     = errors.New("tool not found")
+	errInvalidArguments = errors.New("invalid arguments")
+)
+
+// tool is a function models can call. request returns the API request for the arguments, validated
+// against parameters, on behalf of a user.
+type tool struct {
+	name        string
+	description string
+	parameters  *toolSchema
+	request     func(args map[string]any, userID string) (*http.Request, error)
+}
+
+// ToolDefinition is a tool in the format of the tools of the OpenAI chat completions API.
+type ToolDefinition struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string      `json:"name"`
+		Description string      `json:"description"`
+		Parameters  *toolSchema `json:"parameters"`
+	} `json:"function"`
+}
+
+type InvokeToolRequest struct {
+	Name       string          `json:"name"`
+	Arguments  json.RawMessage `json:"arguments"` // Object, or object encoded in a string like in tool calls
+	UserID     string          `json:"user_id"`
+	ChatID     string          `json:"chat_id"`
+	MessageID  string          `json:"message_id"`
+	ToolCallID string          `json:"tool_call_id"`
+}
+
+// ToolResult is the result of a tool: the response of the API, as JSON if it is, or as text.
+type ToolResult struct {
+	Name       string          `json:"name"`
+	ToolCallID string          `json:"tool_call_id,omitempty"`
+	Status     int             `json:"status"`
+	IsError    bool            `json:"is_error"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// apiRequest returns a request to the API with query parameters, and a JSON body unless body is nil.
+func apiRequest(method, p string, query url.Values, body any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	target := p
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	return req, nil
+}
+
+// filesPath returns the path of an endpoint of the Files API followed by a file path, each element escaped.
+func filesPath(endpoint, p string) string {
+	var b strings.Builder
+	b.WriteString("/api/fs/" + endpoint)
+	for _, element := range strings.Split(strings.Trim(p, "/"), "/") {
+		if element != "" {
+			b.WriteString("/" + url.PathEscape(element))
+		}
+	}
+	return b.String()
+}
+
+// stringArg returns a string argument, or the fallback if it's not set.
+func stringArg(args map[string]any, name, fallback string) string {
+	if value, ok := args[name].(string); ok {
+		return value
+	}
+	return fallback
+}
+
+// limitQuery adds the limit argument, if set, to the query parameters.
+func limitQuery(query url.Values, args map[string]any) url.Values {
+	if limit, ok := args["limit"].(float64); ok {
+		query.Set("limit", strconv.Itoa(int(limit)))
+	}
+	return query
+}
+
+func limitSchema(description string) *toolSchema {
+	minimum := 1.0
+	return &toolSchema{Type: "integer", Description: description, Minimum: &minimum}
+}
+
+var tools = []tool{
+	{
+		name:        "date_now",
+		description: "Returns the current date and time of the user in RFC 3339 format.",
+		parameters:  objectSchema(nil),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			return apiRequest(http.MethodGet, "/api/date.now", nil, nil)
+		},
+	},
+	{
+		name:        "geolocation",
+		description: "Returns the approximate location of the user: city, region, country and coordinates.",
+		parameters:  objectSchema(nil),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			return apiRequest(http.MethodGet, "/api/geolocation", nil, nil)
+		},
+	},
+	{
+		name:        "instant_answer",
+		description: "Looks up a short answer to a query with DuckDuckGo Instant Answers, e.g. a definition or a summary about a topic.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"query": stringSchema("The query, e.g. \"global warming\""),
+		}, "query"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			return apiRequest(http.MethodGet, "/api/search.instant", url.Values{"q": {stringArg(args, "query", "")}}, nil)
+		},
+	},
+	{
+		name:        "reminders_list",
+		description: "Lists the reminders.",
+		parameters:  objectSchema(nil),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			return apiRequest(http.MethodGet, "/api/reminders.list", nil, nil)
+		},
+	},
+	{
+		name:        "reminders_add",
+		description: "Adds a reminder, notified when it's due.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"message":     stringSchema("The reminder message, e.g. \"Buy milk\""),
+			"description": stringSchema("A longer description of the reminder"),
+			"due_time":    {Type: "string", Format: "date-time", Description: "When the reminder is due, in RFC 3339 format"},
+		}, "message", "due_time"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			return apiRequest(http.MethodPost, "/api/reminders.add", nil, map[string]any{
+				"message":     stringArg(args, "message", ""),
+				"description": stringArg(args, "description", ""),
+				"due_time":    stringArg(args, "due_time", ""),
+			})
+		},
+	},
+	{
+		name:        "reminders_complete",
+		description: "Marks a reminder as completed.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"id": stringSchema("The reminder ID"),
+		}, "id"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			return apiRequest(http.MethodPost, "/api/reminders.complete", url.Values{"id": {stringArg(args, "id", "")}}, nil)
+		},
+	},
+	{
+		name:        "files_list",
+		description: "Lists the files and directories in a directory of the files of the user.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"path": stringSchema("The directory path, e.g. \"/documents\" (default: \"/\")"),
+		}),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			return apiRequest(http.MethodGet, filesPath("list", stringArg(args, "path", "/")), url.Values{"user_id": {userID}}, nil)
+		},
+	},
+	{
+		name:        "files_read",
+		description: fmt.Sprintf("Reads a text file of the user. Only the first %dKB of the file are returned.", maxToolResultSize/1024),
+		parameters: objectSchema(map[string]*toolSchema{
+			"path": stringSchema("The file path, e.g. \"/documents/notes.md\""),
+		}, "path"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			req, err := apiRequest(http.MethodGet, filesPath("files", stringArg(args, "path", "")), url.Values{"user_id": {userID}}, nil)
+			if err == nil {
+				req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", maxToolResultSize-1))
+			}
+			return req, err
+		},
+	},
+	{
+		name:        "files_write",
+		description: "Creates a text file in the files of the user. Parent directories are created.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"path":      stringSchema("The file path, e.g. \"/documents/notes.md\""),
+			"content":   stringSchema("The content of the file"),
+			"overwrite": {Type: "boolean", Description: "Replace the content of an existing file instead (default: false)"},
+		}, "path", "content"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			p := normalizePath(stringArg(args, "path", ""))
+			overwrite, _ := args["overwrite"].(bool)
+
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			_ = mw.WriteField("user_id", userID)
+			if !overwrite {
+				_ = mw.WriteField("path", path.Dir(p))
+			}
+			fw, err := mw.CreateFormFile("file", path.Base(p))
+			if err != nil {
+				return nil, err
+			}
+			_, _ = io.WriteString(fw, stringArg(args, "content", ""))
+			if err := mw.Close(); err != nil {
+				return nil, err
+			}
+
+			method, target := http.MethodPost, "/api/fs/files"
+			if overwrite {
+				method, target = http.MethodPut, filesPath("files", p)
+			}
+			req, err := http.NewRequest(method, target, &body)
+			if err == nil {
+				req.Header.Set(echo.HeaderContentType, mw.FormDataContentType())
+			}
+			return req, err
+		},
+	},
+	{
+		name:        "files_search",
+		description: "Searches the text of the files of the user. Files must contain all the words, in any form.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"query": stringSchema("The words to search for"),
+			"path":  stringSchema("Only search in this directory (default: \"/\")"),
+			"limit": limitSchema("The maximum number of results (default: 20)"),
+		}, "query"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			query := url.Values{"user_id": {userID}, "q": {stringArg(args, "query", "")}, "path": {stringArg(args, "path", "/")}}
+			return apiRequest(http.MethodGet, "/api/fs/search", limitQuery(query, args), nil)
+		},
+	},
+	{
+		name:        "chats_search",
+		description: "Searches the past conversations of the user, in the messages and the chat titles.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"query": stringSchema("The words to search for"),
+			"limit": limitSchema("The maximum number of results (default: 20)"),
+		}, "query"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			query := url.Values{"user_id": {userID}, "q": {stringArg(args, "query", "")}}
+			return apiRequest(http.MethodGet, "/api/messages.search", limitQuery(query, args), nil)
+		},
+	},
+	{
+		name:        "chats_list",
+		description: "Lists the chats of the user, the most recent first.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"query": stringSchema("Only list the chats with titles containing this text"),
+			"limit": limitSchema("The maximum number of chats (default: 50)"),
+		}),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			query := url.Values{"user_id": {userID}}
+			if q := stringArg(args, "query", ""); q != "" {
+				query.Set("q", q)
+			}
+			// A limit gets a page, chats.list returns all the chats without one
+			if _, ok := args["limit"]; !ok {
+				query.Set("limit", strconv.Itoa(defaultChatsLimit))
+			}
+			return apiRequest(http.MethodGet, "/api/chats.list", limitQuery(query, args), nil)
+		},
+	},
+	{
+		name:        "storage_list_buckets",
+		description: "Lists the buckets of the object storage.",
+		parameters:  objectSchema(nil),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			return apiRequest(http.MethodGet, "/api/storage/buckets", nil, nil)
+		},
+	},
+	{
+		name:        "storage_list_objects",
+		description: "Lists the objects of a bucket of the object storage.",
+		parameters: objectSchema(map[string]*toolSchema{
+			"bucket": stringSchema("The bucket name"),
+			"prefix": stringSchema("Only list the objects with keys starting with this prefix"),
+		}, "bucket"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			query := url.Values{}
+			if prefix := stringArg(args, "prefix", ""); prefix != "" {
+				query.Set("prefix", prefix)
+			}
+			return apiRequest(http.MethodGet, "/api/storage/buckets/"+url.PathEscape(stringArg(args, "bucket", ""))+"/objects", query, nil)
+		},
+	},
+	{
+		name:        "storage_get_object",
+		description: fmt.Sprintf("Reads a text object of the object storage. Only the first %dKB of the object are returned.", maxToolResultSize/1024),
+		parameters: objectSchema(map[string]*toolSchema{
+			"bucket": stringSchema("The bucket name"),
+			"key":    stringSchema("The object key"),
+		}, "bucket", "key"),
+		request: func(args map[string]any, userID string) (*http.Request, error) {
+			req, err := apiRequest(http.MethodGet, "/api/storage/buckets/"+url.PathEscape(stringArg(args, "bucket", ""))+"/objects/"+url.PathEscape(stringArg(args, "key", "")), nil, nil)
+			if err == nil {
+				req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", maxToolResultSize-1))
+			}
+			return req, err
+		},
+	},
+}
+
+// findTool returns the tool with the name.
+func findTool(name string) (tool, error) {
+	for _, t := range tools {
+		if t.name == name {
+			return t, nil
+		}
+	}
+	return tool{}, errToolNotFound
+}
+
+// toolDefinitions returns the definitions of all the tools.
+func toolDefinitions() []ToolDefinition {
+	definitions := make([]ToolDefinition, 0, len(tools))
+	for _, t := range tools {
+		var d ToolDefinition
+		d.Type = "function"
+		d.Function.Name, d.Function.Description, d.Function.Parameters = t.name, t.description, t.parameters
+		definitions = append(definitions, d)
+	}
+	return definitions
+}
+
+// decodeArguments decodes the arguments of a tool, a JSON object or a string holding one.
+// Missing arguments are an empty object.
+func decodeArguments(raw json.RawMessage) (map[string]any, error) {
+	raw = compactJSON(raw)
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err == nil {
+		raw = compactJSON(json.RawMessage(encoded))
+	}
+	args := map[string]any{}
+	if len(raw) == 0 {
+		return args, nil
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, fmt.Errorf("arguments: expected an object")
+	}
+	return args, nil
+}
+
+// toolResponse converts the response of the API to the result of a tool.
+func toolResponse(rec *httptest.ResponseRecorder) json.RawMessage {
+	body := rec.Body.Bytes()
+	if strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), echo.MIMEApplicationJSON) && len(body) <= maxToolResultSize && json.Valid(body) {
+		return compactJSON(body)
+	}
+
+	text := string(body)
+	if len(body) > maxToolResultSize {
+		text = strings.ToValidUTF8(string(body[:maxToolResultSize]), "") + "\n[truncated]"
+	}
+	if !utf8.ValidString(text) {
+		text = fmt.Sprintf("[binary content, %d bytes, %s]", len(body), rec.Header().Get(echo.HeaderContentType))
+	}
+	result, _ := json.Marshal(strings.TrimSpace(text))
+	return result
+}
+
+// invokeTool validates the arguments of a tool and serves its request with the server, on behalf of
+// a user. The request comes from the client of the original request, or from the local host without one.
+func invokeTool(ctx context.Context, server http.Handler, original *http.Request, name string, rawArgs json.RawMessage, userID string) (ToolResult, error) {
+	t, err := findTool(name)
+	if err != nil {
+		return ToolResult{}, err
+	}
+	args, err := decodeArguments(rawArgs)
+	if err == nil {
+		err = t.parameters.validate(args, "arguments")
+	}
+	if err != nil {
+		return ToolResult{}, fmt.Errorf("%w: %v", errInvalidArguments, err)
+	}
+
+	req, err := t.request(args, userID)
+	if err != nil {
+		return ToolResult{}, err
+	}
+	req = req.WithContext(ctx)
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+	if original != nil {
+		req.RemoteAddr = original.RemoteAddr
+		for _, header := range []string{echo.HeaderXForwardedFor, echo.HeaderXRealIP} {
+			if value := original.Header.Get(header); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return ToolResult{
+		Name:    name,
+		Status:  rec.Code,
+		IsError: rec.Code >= http.StatusBadRequest,
+		Result:  toolResponse(rec),
+	}, nil
+}
+
+// recordToolResult adds the result to the tool call of a message with the same ID, or adds the call
+// with its result if the message has no such call.
+func recordToolResult(q dbtx, chatID, messageID string, args json.RawMessage, result ToolResult) error {
+	var tools []byte
+	err := q.QueryRow("SELECT tools FROM messages WHERE id = ? AND chat_id = ?", messageID, chatID).Scan(&tools)
+	if err == sql.ErrNoRows {
+		return errMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+	calls := []map[string]any{}
+	if len(compactJSON(tools)) > 0 {
+		if err := json.Unmarshal(tools, &calls); err != nil {
+			return fmt.Errorf("%w: the tools of the message are not a list", errInvalidArguments)
+		}
+	}
+
+	var call map[string]any
+	for _, c := range calls {
+		if id, _ := c["id"].(string); id != "" && id == result.ToolCallID {
+			call = c
+			break
+		}
+	}
+	if call == nil {
+		arguments := string(compactJSON(args))
+		var encoded string
+		if json.Unmarshal(args, &encoded) == nil {
+			arguments = encoded
+		}
+		call = map[string]any{
+			"id":       result.ToolCallID,
+			"type":     "function",
+			"function": map[string]any{"name": result.Name, "arguments": arguments},
+		}
+		calls = append(calls, call)
+	}
+	call["result"], call["status"] = result.Result, result.Status
+
+	tools, err = json.Marshal(calls)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("UPDATE messages SET tools = ? WHERE id = ?", tools, messageID)
+	return err
+}
+
+// withoutToolResults removes the results recorded in tool calls, leaving the calls of the model.
+func withoutToolResults(tools json.RawMessage) json.RawMessage {
+	var calls []map[string]any
+	if err := json.Unmarshal(tools, &calls); err != nil {
+		return tools
+	}
+	for _, call := range calls {
+		delete(call, "result")
+		delete(call, "status")
+	}
+	stripped, err := json.Marshal(calls)
+	if err != nil {
+		return tools
+	}
+	return stripped
+}
+
+func SetupToolApiHandlers(apiGroup *echo.Group, db *sql.DB, server http.Handler) {
+	log.Info().Msg("Initializing Tools API")
+
+	apiGroup.GET("/tools.list", ListToolsHandler())
+	apiGroup.POST("/tools.invoke", InvokeToolHandler(db, server))
+}
+
+// ListToolsHandler returns the definitions of the tools, which can be passed as is to chat completions
+func ListToolsHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, toolDefinitions())
+	}
+}
+
+// InvokeToolHandler calls a tool. With chat_id and message_id, the call and its result are recorded
+// in the tools of the message.
+func InvokeToolHandler(db *sql.DB, server http.Handler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := new(InvokeToolRequest)
+		if err := c.Bind(req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+		record := req.ChatID != "" && req.MessageID != ""
+		if record {
+			if _, err := findChat(db, req.ChatID, req.UserID); err != nil {
+				return respondChatError(c, err)
+			}
+			if err := checkMessage(db, req.ChatID, req.MessageID); err != nil {
+				return respondChatError(c, err)
+			}
+		}
+
+		result, err := invokeTool(c.Request().Context(), server, c.Request(), req.Name, req.Arguments, req.UserID)
+		if err == errToolNotFound {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Tool not found"})
+		}
+		if errors.Is(err, errInvalidArguments) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to invoke tool")
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+
+		result.ToolCallID = req.ToolCallID
+		if record {
+			if result.ToolCallID == "" {
+				result.ToolCallID = "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+			}
+			err := inTransaction(db, func(tx *sql.Tx) error {
+				return recordToolResult(tx, req.ChatID, req.MessageID, req.Arguments, result)
+			})
+			if errors.Is(err, errInvalidArguments) {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "The tools of the message are not a list"})
+			}
+			if err != nil {
+				return respondChatError(c, err)
+			}
+		}
+
+		return c.JSON(http.StatusOK, result)
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// toolSchema is the subset of JSON Schema used to describe the arguments of tools.
+type toolSchema struct {
+	Type                 string                 `json:"type"`
+	Description          string                 `json:"description,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Properties           map[string]*toolSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+}
+
+// objectSchema returns the schema of an object with the properties, which rejects other properties.
+func objectSchema(properties map[string]*toolSchema, required ...string) *toolSchema {
+	additional := false
+	if properties == nil {
+		properties = map[string]*toolSchema{}
+	}
+	return &toolSchema{Type: "object", Properties: properties, Required: required, AdditionalProperties: &additional}
+}
+
+func stringSchema(description string) *toolSchema {
+	return &toolSchema{Type: "string", Description: description}
+}
+
+// validate checks a value decoded from JSON against the schema. The error names the invalid argument.
+func (s *toolSchema) validate(value any, name string) error {
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object", name)
+		}
+		for _, key := range s.Required {
+			if _, ok := object[key]; !ok {
+				return fmt.Errorf("%s: missing required property %q", name, key)
+			}
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property, ok := s.Properties[key]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unknown property %q", name, key)
+				}
+				continue
+			}
+			if err := property.validate(object[key], name+"."+key); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string", name)
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			return fmt.Errorf("%s: expected one of %s", name, strings.Join(s.Enum, ", "))
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("%s: expected a date and time in RFC 3339 format", name)
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok || (s.Type == "integer" && n != math.Trunc(n)) {
+			return fmt.Errorf("%s: expected a %s", name, s.Type)
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fmt.Errorf("%s: expected at least %v", name, *s.Minimum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean", name)
+		}
+	}
+	return nil
+}
@@ -11,3 +11,16 @@ func rollback(tx *sql.Tx) {
 		log.Error().Err(err).Msg("Failed to rollback transaction")
 	}
 }
+
+// inTransaction runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise.
+func inTransaction(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		rollback(tx)
+		return err
+	}
+	return tx.Commit()
+}
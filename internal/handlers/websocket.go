@@ -20,20 +20,52 @@ type Message struct {
 	Content string `json:"content"`
 }
 
+// wsSendBuffer is the number of messages queued for a client before new messages are dropped.
+const wsSendBuffer = 256
+
+// wsClient is a connected client. Clients subscribed to channels only receive the messages of those channels.
+// Messages are written in order by a single goroutine, connections don't support concurrent writers.
+type wsClient struct {
+	channels map[string]bool
+	send     chan Message
+}
+
+func (cl *wsClient) writeMessages(conn *websocket.Conn) {
+	for m := range cl.send {
+		if err := conn.WriteJSON(m); err != nil {
+			log.Println("WebSocket write error:", err)
+			// Closing the connection ends the read loop, which removes the client
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+func (cl *wsClient) subscribed(channel string) bool {
+	return len(cl.channels) == 0 || cl.channels[channel]
+}
+
 type WebSocketHandler struct {
-	clients   map[*websocket.Conn]bool
+	clients   map[*websocket.Conn]*wsClient
 	mutex     sync.Mutex
 	broadcast chan Message
 }
 
 func NewWebSocketHandler() *WebSocketHandler {
 	return &WebSocketHandler{
-		clients:   make(map[*websocket.Conn]bool),
+		clients:   make(map[*websocket.Conn]*wsClient),
 		broadcast: make(chan Message),
 	}
 }
 
+// HandleWebSocket connects a client. The channel query parameter, repeated for each channel,
+// subscribes the client to those channels only.
 func (h *WebSocketHandler) HandleWebSocket(c echo.Context) error {
+	client := &wsClient{channels: map[string]bool{}, send: make(chan Message, wsSendBuffer)}
+	for _, channel := range c.QueryParams()["channel"] {
+		client.channels[channel] = true
+	}
+
 	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		log.Println("WebSocket upgrade failed:", err)
@@ -46,9 +78,10 @@ func (h *WebSocketHandler) HandleWebSocket(c echo.Context) error {
 	}()
 
 	h.mutex.Lock()
-	h.clients[conn] = true
+	h.clients[conn] = client
 	h.mutex.Unlock()
 	log.Println("New WebSocket client connected")
+	go client.writeMessages(conn)
 
 	for {
 		_, _, err := conn.ReadMessage()
@@ -56,6 +89,7 @@ func (h *WebSocketHandler) HandleWebSocket(c echo.Context) error {
 			log.Println("WebSocket read error:", err)
 			h.mutex.Lock()
 			delete(h.clients, conn)
+			close(client.send)
 			h.mutex.Unlock()
 			break
 		}
@@ -68,16 +102,15 @@ func (h *WebSocketHandler) HandleMessages() {
 		message := <-h.broadcast
 		log.Println("Broadcasting message to channel:", message.Channel)
 		h.mutex.Lock()
-		for conn := range h.clients {
-			// Here you can add logic to filter clients by channel if needed
-			go func(c *websocket.Conn, m Message) {
-				if err := c.WriteJSON(m); err != nil {
-					log.Println("WebSocket write error:", err)
-					h.mutex.Lock()
-					delete(h.clients, c)
-					h.mutex.Unlock()
-				}
-			}(conn, message)
+		for conn, client := range h.clients {
+			if !client.subscribed(message.Channel) {
+				continue
+			}
+			select {
+			case client.send <- message:
+			default:
+				log.Println("WebSocket client too slow, message dropped for", conn.RemoteAddr())
+			}
 		}
 		h.mutex.Unlock()
 	}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,6 +16,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/Kesertki/portal/internal/fssync"
 	"github.com/Kesertki/portal/internal/handlers"
 	"github.com/Kesertki/portal/internal/storage"
 )
@@ -27,7 +30,8 @@ var (
 const dbPath = "./data/portal.db"
 
 func main() {
-	fmt.Printf("%s v%s (Commit: %s, Built: %s)\n", "[portal]", Version, GitCommit, BuildDate)
+	// Printed on stderr, stdout carries the messages of portal mcp
+	fmt.Fprintf(os.Stderr, "%s v%s (Commit: %s, Built: %s)\n", "[portal]", Version, GitCommit, BuildDate)
 
 	// Configure logger
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
@@ -38,6 +42,14 @@ func main() {
 		log.Warn().Msg("Error loading .env file")
 	}
 
+	// portal sync runs the sync client instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		if err := fssync.Run(os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Sync failed")
+		}
+		return
+	}
+
 	storage.ApplyMigrations()
 
 	// Log environment variables
@@ -55,13 +67,34 @@ func main() {
 	}()
 
 	e := echo.New()
+	api := handlers.NewAPI(db)
 
-	// CORS configuration to allow all origins
+	// The storage API uses the CORS configuration of the requested bucket,
+	// everything else uses the configurable CORS policy (all origins by default), including listing the buckets
+	isBucketRequest := func(c echo.Context) bool {
+		return strings.HasPrefix(c.Request().URL.Path, "/api/storage") && c.Param("bucket") != ""
+	}
+	// OPTIONS requests that are not preflight requests are passed on to the routes (e.g. tus discovery)
+	isPlainOptionsRequest := func(c echo.Context) bool {
+		return c.Request().Method == http.MethodOptions && c.Request().Header.Get(echo.HeaderAccessControlRequestMethod) == ""
+	}
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"}, // Allow all origins
-		AllowMethods: []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete},
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		Skipper: func(c echo.Context) bool {
+			return isBucketRequest(c) || isPlainOptionsRequest(c)
+		},
+		AllowOrigins: envList("PORTAL_CORS_ALLOW_ORIGINS", []string{"*"}),
+		AllowMethods: envList("PORTAL_CORS_ALLOW_METHODS", []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete}),
+		AllowHeaders: envList("PORTAL_CORS_ALLOW_HEADERS", []string{
+			echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization,
+			"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset",
+		}),
+		ExposeHeaders: envList("PORTAL_CORS_EXPOSE_HEADERS", []string{
+			echo.HeaderLocation, "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Length", "Upload-Offset",
+		}),
+		AllowCredentials: os.Getenv("PORTAL_CORS_ALLOW_CREDENTIALS") == "true",
+		MaxAge:           envInt("PORTAL_CORS_MAX_AGE", 0),
 	}))
+	e.Use(api.BucketCORS(func(c echo.Context) bool { return !isBucketRequest(c) }))
 
 	// Middleware
 	e.Pre(middleware.RemoveTrailingSlash())
@@ -81,23 +114,33 @@ func main() {
 
 	e.Static("/", "public")
 
+	// Start WebSocket handler
+	log.Info().Msg("Starting WebSocket handler")
+	wsHandler := handlers.NewWebSocketHandler()
+	wsHandler.StartBroadcasting()
+
 	apiGroup := e.Group("/api")
 	// apiGroup.GET("/version", handlers.GetVersion)
 
 	e.POST("/api/users.add", func(c echo.Context) error { return createUser(c, db) })
 
 	handlers.SetupReminderApiHandlers(apiGroup, db)
-	handlers.SetupChatApiHandlers(apiGroup, db)
+	handlers.SetupChatApiHandlers(apiGroup, db, wsHandler)
 	handlers.SetupFileSystemApiHandlers(apiGroup, db)
+	handlers.SetupFileShareHandlers(e.Group("/s"), db)
+	handlers.SetupWebDAVHandlers(e.Group("/dav"), db)
+	handlers.SetupCompletionsProxyHandlers(e.Group("/v1"), db, wsHandler)
+	handlers.SetupToolApiHandlers(apiGroup, db, e)
+	handlers.SetupMCPHandlers(e.Group("/mcp"), db, e, Version)
 
 	// Storage API
-	api := handlers.NewAPI(db)
 	storageApi := apiGroup.Group("/storage")
 	// storageApi := e
 
 	storageApi.GET("/buckets", api.ListBuckets)
 	storageApi.POST("/buckets/:bucket", api.CreateBucket)
 	storageApi.DELETE("/buckets/:bucket", api.DeleteBucket)
+	storageApi.POST("/buckets/:bucket/policies", api.CreatePostPolicy)
 	storageApi.PUT("/buckets/:bucket/objects/:key", api.UploadObject)
 	storageApi.POST("/buckets/:bucket/objects/:key", api.InitiateMultipartUpload)
 	storageApi.PUT("/buckets/:bucket/objects/:key/uploads", api.UploadPart)
@@ -112,23 +155,71 @@ func main() {
 	storageApi.GET("", api.ListBuckets)
 	storageApi.GET("/:bucket", api.ListObjects)
 	storageApi.PUT("/:bucket", api.CreateBucket)
+	storageApi.POST("/:bucket", api.PostObject)
+	storageApi.PUT("/:bucket/:key", api.UploadObject)
 	// Catch-all route for S3 API
 	storageApi.Match([]string{http.MethodGet, http.MethodHead}, "/:bucket/:key", api.GetObject)
 	storageApi.DELETE("/:bucket", api.DeleteBucket)
 	storageApi.DELETE("/:bucket/:key", api.DeleteObject)
 
-	// Start WebSocket handler
-	log.Info().Msg("Starting WebSocket handler")
-	wsHandler := handlers.NewWebSocketHandler()
-	wsHandler.StartBroadcasting()
+	// CORS preflight requests, answered by the bucket CORS middleware, or by the global one without bucket
+	for _, path := range []string{
+		"", "/buckets", "/buckets/:bucket", "/buckets/:bucket/objects", "/buckets/:bucket/objects/:key",
+		"/buckets/:bucket/objects/:key/uploads", "/buckets/:bucket/objects/:key/complete",
+		"/:bucket", "/:bucket/:key",
+	} {
+		storageApi.OPTIONS(path, api.Options)
+	}
+
 	e.GET("/ws", wsHandler.HandleWebSocket)
 
+	// portal mcp serves the MCP server on stdio instead of listening, with the same handlers
+	if len(os.Args) > 1 && os.Args[1] == "mcp" {
+		if err := handlers.RunMCP(os.Args[2:], db, e, Version); err != nil {
+			log.Fatal().Err(err).Msg("MCP server failed")
+		}
+		return
+	}
+
 	// Start reminders agent
 	go handlers.StartRemindersAgent(wsHandler)
 
+	// Start file change notifier
+	go handlers.StartFileChangeNotifier(db, wsHandler)
+
+	// Start upload purge agent
+	go handlers.StartUploadPurgeAgent(db)
+
+	// Start trash purge agent
+	go handlers.StartTrashPurgeAgent(db)
+
 	e.Logger.Fatal(e.Start(":1323"))
 }
 
+// envList returns a comma separated list from the environment, or the fallback if the variable is not set
+func envList(name string, fallback []string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envInt returns an integer from the environment, or the fallback if the variable is not set or invalid
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
 // Create a new user
 func createUser(c echo.Context, db *sql.DB) error {
 	name := c.FormValue("name")